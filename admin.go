@@ -0,0 +1,89 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// A walker is a DataBroker which can enumerate its registered patterns.
+type walker interface {
+	Walk(fn func(pattern string, class int))
+}
+
+// writeJSON writes v to w as a JSON document with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// AdminHandler returns a handler exposing an operator's control panel for the
+// server as a set of JSON endpoints:
+//
+//	GET  /templates  the templates currently cached and all those available
+//	GET  /stats      cache statistics
+//	POST /reload     discard cached templates (see Reload)
+//	GET  /broker     the patterns registered with the server's broker
+//
+// The broker listing is empty unless the broker can enumerate its patterns,
+// as Broker does. The handler performs no authentication of its own and
+// should be mounted separately from the server, behind whatever access
+// control is appropriate, for example:
+//
+//	http.Handle("/admin/", requireAuth(http.StripPrefix("/admin", srv.AdminHandler())))
+func (srv *TemplateServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/templates", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cached":    srv.Cached(),
+			"available": srv.Templates(),
+		})
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := srv.Stats()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cached_templates": stats.CachedTemplates,
+			"hits":             stats.Hits,
+			"misses":           stats.Misses,
+			"evictions":        stats.Evictions,
+		})
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+				"error": "method not allowed",
+			})
+			return
+		}
+
+		if err := srv.Reload(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"reloaded": true,
+		})
+	})
+	mux.HandleFunc("/broker", func(w http.ResponseWriter, r *http.Request) {
+		type registration struct {
+			Pattern string `json:"pattern"`
+			Class   int    `json:"class"`
+		}
+
+		reg := []registration{}
+		if wb, ok := srv.broker.(walker); ok {
+			wb.Walk(func(pattern string, class int) {
+				reg = append(reg, registration{pattern, class})
+			})
+		}
+		writeJSON(w, http.StatusOK, reg)
+	})
+
+	return mux
+}
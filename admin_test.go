@@ -0,0 +1,101 @@
+package gtemplate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	admin := srv.AdminHandler()
+
+	for _, elem := range []string{"/", "/temp.gohtml"} {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", elem, nil))
+	}
+
+	available := []interface{}{}
+	for _, elem := range srv.Templates() {
+		available = append(available, elem)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		status   int
+		expected interface{}
+	}{
+		{"GET", "/templates", http.StatusOK, map[string]interface{}{
+			"cached":    []interface{}{"/index.gohtml", "/temp.gohtml"},
+			"available": available,
+		}},
+		{"GET", "/stats", http.StatusOK, map[string]interface{}{
+			"cached_templates": 2.0,
+			"hits":             0.0,
+			"misses":           2.0,
+			"evictions":        0.0,
+		}},
+		{"GET", "/broker", http.StatusOK, []interface{}{}},
+		{"GET", "/reload", http.StatusMethodNotAllowed, map[string]interface{}{
+			"error": "method not allowed",
+		}},
+		{"POST", "/reload", http.StatusOK, map[string]interface{}{
+			"reloaded": true,
+		}},
+		{"GET", "/templates", http.StatusOK, map[string]interface{}{
+			"cached":    []interface{}{},
+			"available": available,
+		}},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(elem.method, elem.path, nil))
+
+		if w.Code != elem.status {
+			t.Errorf("admin %s %s: got status %d, expected %d", elem.method, elem.path, w.Code, elem.status)
+		}
+
+		var got interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Errorf("admin %s %s: invalid json: %s", elem.method, elem.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, elem.expected) {
+			t.Errorf("admin %s %s: got %v, expected %v", elem.method, elem.path, got, elem.expected)
+		}
+	}
+}
+
+func TestAdminBroker(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/", map[string]interface{}{})
+	broker.HandleFunc("/temp.gohtml", func(path string) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	srv, err := NewServer(TestDocumentRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/broker", nil))
+
+	var got interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("admin broker: invalid json: %s", err)
+	}
+	expected := []interface{}{
+		map[string]interface{}{"pattern": "/", "class": float64(ConstHandler)},
+		map[string]interface{}{"pattern": "/temp.gohtml", "class": float64(FuncHandler)},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("admin broker: got %v, expected %v", got, expected)
+	}
+}
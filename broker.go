@@ -1,7 +1,12 @@
 package gtemplate
 
 import (
+	"net"
+	"net/http"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -16,12 +21,13 @@ const (
 
 // Useful path constants.
 const (
-	DirectoryIndex = "index.gohtml"
+	DefaultExtension = ".gohtml"
+	DirectoryIndex   = "index" + DefaultExtension
 )
 
 // BrokerFunc handles a request for data for a specific route. If error is
-// non-nil, request will return a map with only one entry "error" set to the
-// error returned.
+// non-nil, request will return a map with only one entry "error" (ErrorKey)
+// set to the error returned. See TemplateServer.ErrorTemplate.
 type BrokerFunc func(string) (map[string]interface{}, error)
 
 // Default data broker.
@@ -32,121 +38,523 @@ var DefaultDataBroker = NewBroker()
 // each incoming request against a list of registered patterns and fetches the
 // data (through whatever registered means) for this specific route. It is
 // designed to be analogous to the http.ServeMux handler. See documentation for
-// http.ServeMux for details on pattern matching.
+// http.ServeMux for details on pattern matching. Patterns must be clean, as by
+// path.Clean but for a trailing slash, and registering one containing a ".."
+// element panics.
+//
+// Patterns may also contain glob metacharacters, as understood by path.Match,
+// such as "/blog/*.gohtml" or "/api/v*/". A glob ending in a slash matches
+// the directory and everything within it. Globs are consulted only when no
+// handler is registered for exactly the requested path and, when several
+// match, the one with the longest literal prefix wins.
+//
+// Patterns may also contain parameter segments of the form ":name", such as
+// "/user/:id/profile.gohtml", each of which matches any single path segment.
+// The values captured are added to the data under ParamsKey. As with globs,
+// a parameterized pattern ending in a slash matches everything within the
+// directory. A parameter may be followed by an extension, as in
+// "/user/:id/:page.gohtml", which must then be matched literally.
+// Parameterized patterns are consulted after exact matches but before globs
+// and, when several match, literal segments take precedence over parameters,
+// from left to right. A TemplateServer using a Broker serves requests matching a
+// parameterized pattern with the template at the pattern's own path, such as
+// "user/:id/profile.gohtml" within the document root.
+//
+// Where patterns are not expressive enough, handlers may be registered for
+// regular expressions with HandleRegex, which are consulted last.
+//
+// Data registered for a directory is inherited by everything within it: the
+// maps returned by the handlers of each enclosing directory are merged with
+// that of the most specific handler, with more specific keys taking
+// precedence.
+//
+// Handlers may also be scoped to an HTTP method with HandleMethod and its
+// variants, such as to process a form submitted by POST to the page which
+// displays it, or to a virtual host with Host and its variants. See
+// DataForRequest.
 type Broker struct {
-	mu  sync.RWMutex                      // protects reg
-	reg map[string]map[string]brokerEntry // a map of directories with path entries
+	// Extension is the file extension of templates, from which the name
+	// of each directory's index is derived ("index" + Extension). If
+	// empty, DefaultExtension is used.
+	Extension string
+
+	// Index is the file name of each directory's index. If empty, it is
+	// derived from Extension.
+	//
+	// Both are taken from the server when the Broker is given to
+	// NewServerOpts, unless either is already set, and must otherwise be
+	// set to match the server's Extension and Index before any handlers
+	// are registered.
+	Index string
+
+	mu      sync.RWMutex                      // protects reg, params, globs, regex, methods and hosts
+	reg     map[string]map[string]brokerEntry // a map of directories with path entries
+	params  []paramEntry                      // parameterized patterns, most specific first
+	globs   []globEntry                       // glob patterns, most specific first
+	regex   []regexEntry                      // regular expressions, in registration order
+	methods map[string]*Broker                // method-scoped handlers, by method
+	hosts   map[string]*Broker                // host-scoped handlers, by host name
 }
 
 type brokerEntry struct {
 	// Type of entry (see type constants above)
 	class int
 
+	// Set if automatically registered as a directory's index handler
+	autoIndex bool
+
+	// Set if a directory's handler which does not apply to its index
+	noIndex bool
+
 	// Handler objects
 	mapHandler    map[string]interface{}
 	funcHandler   BrokerFunc
 	brokerHandler DataBroker
 }
 
-func stringBacktrace(orig, to string) string {
-	i := strings.LastIndex(orig, to)
-	if i == -1 {
-		return orig
+// globEntry is a handler registered for a pattern containing glob
+// metacharacters, as understood by path.Match.
+type globEntry struct {
+	pattern string
+	literal int // length of the literal prefix of pattern
+	entry   brokerEntry
+}
+
+// ParamsKey is the data key under which a Broker provides the values of the
+// parameters captured by a parameterized pattern, as a map[string]string.
+const ParamsKey = "params"
+
+// paramEntry is a handler registered for a pattern containing parameter
+// segments of the form ":name".
+type paramEntry struct {
+	pattern  string
+	segments []string // segments of pattern, without the trailing slash
+	dir      bool     // pattern ends in a slash
+	entry    brokerEntry
+}
+
+// before reports whether e is more specific than o, being the first of them
+// to have a literal segment where the other has a parameter.
+func (e paramEntry) before(o paramEntry) bool {
+	for i := 0; i < len(e.segments) && i < len(o.segments); i++ {
+		lit, olit := e.segments[i][0] != ':', o.segments[i][0] != ':'
+		if lit != olit {
+			return lit
+		}
+	}
+
+	return false
+}
+
+// isParam reports whether pattern contains any parameter segments.
+func isParam(pattern string) bool {
+	return strings.HasPrefix(pattern, ":") || strings.Contains(pattern, "/:")
+}
+
+// match returns the parameters captured from p if it matches the pattern.
+func (e paramEntry) match(p string) (map[string]string, bool) {
+	segs := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if len(segs) < len(e.segments) || (!e.dir && len(segs) != len(e.segments)) ||
+		(e.dir && len(segs) == len(e.segments)) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, elem := range e.segments {
+		if elem[0] != ':' {
+			if segs[i] != elem {
+				return nil, false
+			}
+			continue
+		}
+
+		// Parameters may be followed by a literal extension
+		name, ext, _ := strings.Cut(elem[1:], ".")
+		if ext != "" {
+			ext = "." + ext
+		}
+		if len(segs[i]) <= len(ext) || !strings.HasSuffix(segs[i], ext) {
+			return nil, false
+		}
+
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = strings.TrimSuffix(segs[i], ext)
+	}
+
+	return params, true
+}
+
+// regexEntry is a handler registered for a regular expression.
+type regexEntry struct {
+	re    *regexp.Regexp
+	entry brokerEntry
+}
+
+// match returns the groups captured from p if it matches the expression,
+// keyed by both index and, for named groups, name.
+func (e regexEntry) match(p string) (map[string]string, bool) {
+	m := e.re.FindStringSubmatch(p)
+	if m == nil {
+		return nil, false
 	}
-	return orig[:i+1]
+
+	params := make(map[string]string, len(m)-1)
+	for i, name := range e.re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+
+		params[strconv.Itoa(i)] = m[i]
+		if name != "" {
+			params[name] = m[i]
+		}
+	}
+
+	return params, true
+}
+
+// isGlob reports whether pattern contains any glob metacharacters.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// match reports whether p matches the glob. Patterns ending in a slash match
+// the directory itself and any path within it.
+func (g globEntry) match(p string) bool {
+	if g.pattern[len(g.pattern)-1] == '/' {
+		depth := strings.Count(g.pattern, "/")
+		i := 0
+		for ; i < len(p) && depth > 0; i++ {
+			if p[i] == '/' {
+				depth--
+			}
+		}
+		if depth > 0 {
+			return false
+		}
+		p = p[:i]
+	}
+
+	ok, _ := path.Match(g.pattern, p)
+	return ok
+}
+
+// index returns the file name of a directory's index.
+func (b *Broker) index() string {
+	if b.Index != "" {
+		return b.Index
+	}
+	if b.Extension == "" {
+		return DirectoryIndex
+	}
+
+	return "index" + b.Extension
 }
 
 func NewBroker() *Broker {
 	return new(Broker)
 }
 
-func (b *Broker) Data(path string) map[string]interface{} {
-	hndl, ok := b.lookupHandler(path)
-	if ok {
-		switch hndl.class {
-		case BrokerHandler:
-			return hndl.brokerHandler.Data(path)
-		case ConstHandler:
-			return hndl.mapHandler
-		case FuncHandler:
-			dat, err := hndl.funcHandler(path)
-			if err != nil {
-				dat = make(map[string]interface{})
-				dat["error"] = err.Error()
+// adopt sets the Extension and Index of b, and of its scoped brokers, to those
+// of a server given b, unless either is already set or the server's index is
+// that of b already. The automatic index handlers of the directories already
+// registered are moved to the new index.
+func (b *Broker) adopt(ext, index string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.Extension != "" || b.Index != "" {
+		return
+	}
+	next := index
+	if next == "" {
+		next = "index" + ext
+	}
+	prev := b.index()
+	if next == prev {
+		return
+	}
+	b.Extension, b.Index = ext, index
+
+	for dir, m := range b.reg {
+		old, idx := path.Join(dir, prev), path.Join(dir, next)
+		if s, ok := m[old]; ok && s.autoIndex {
+			delete(m, old)
+			if _, ok := m[idx]; !ok {
+				m[idx] = s
 			}
+		}
+	}
+	for _, sb := range b.methods {
+		sb.adopt(ext, index)
+	}
+	for _, sb := range b.hosts {
+		sb.adopt(ext, index)
+	}
+}
+
+// Data returns the data for path. The data of the handlers of each directory
+// enclosing path is merged, from the root down, with that of the handler for
+// path itself, such that more specific handlers override the keys of those
+// registered for their parent directories. If path matches a parameterized
+// pattern, the captured parameters are added under ParamsKey, unless a
+// handler sets that key itself.
+func (b *Broker) Data(path string) map[string]interface{} {
+	chain, params := b.lookupHandler(path)
+	if len(chain) == 1 && params == nil {
+		return chain[0].data(path)
+	}
+
+	var dat map[string]interface{}
+	if params != nil {
+		dat = map[string]interface{}{
+			ParamsKey: params,
+		}
+	}
+	for _, elem := range chain {
+		m := elem.data(path)
+		if m == nil {
+			continue
+		}
+		if dat == nil {
+			dat = make(map[string]interface{}, len(m))
+		}
+		for k, v := range m {
+			dat[k] = v
+		}
+	}
+
+	return dat
+}
+
+// DataForRequest returns the data for the path of r, as Data, preferring the
+// handlers scoped to the host of r, then those scoped to its method. If any
+// handler registered for the host matches the path, including those of
+// enclosing directories, only the host's handlers are used, and likewise for
+// the method. Otherwise, the data is that of the handlers registered for any
+// host and method. Handlers scoped to GET also apply to HEAD requests, unless
+// handlers are scoped to HEAD itself.
+func (b *Broker) DataForRequest(r *http.Request) map[string]interface{} {
+	return b.forRequest(r).Data(r.URL.Path)
+}
 
-			return dat
-		case NilHandler:
-		default:
-			panic("gtemplate: broker: unknown handler type")
+// forRequest returns the broker whose handlers serve r: that of its host or
+// method if either has a handler matching its path, or else b.
+func (b *Broker) forRequest(r *http.Request) *Broker {
+	b.mu.RLock()
+	hb, hok := b.hosts[hostname(r.Host)]
+	mb, mok := b.methods[r.Method]
+	if !mok && r.Method == "HEAD" {
+		mb, mok = b.methods["GET"]
+	}
+	b.mu.RUnlock()
+
+	if hok {
+		if sub := hb.forRequest(r); sub != hb || hb.handles(r.URL.Path) {
+			return sub
 		}
 	}
+	if mok && mb.handles(r.URL.Path) {
+		return mb
+	}
 
-	return nil
+	return b
 }
 
-// lookupHandler traverses the handler stores and finds the most suitable entry
-// If none was found, returns zero value and false, else returns entry and true
-// The algorithm to lookup is as follows:
-//
-// For directories:
-//  1. Lookup in the map
-//  2. If present, return the directory's root handler
-//  3. Else, return false
+// handles reports whether any handler of b matches path.
+func (b *Broker) handles(path string) bool {
+	chain, params := b.lookupHandler(path)
+	return len(chain) > 0 || params != nil
+}
+
+// hostname returns the host name of a Host header, without any port, in the
+// form under which host-scoped handlers are registered.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// data calls the handler for the entry to fetch the data for path.
+func (e brokerEntry) data(path string) map[string]interface{} {
+	switch e.class {
+	case BrokerHandler:
+		return e.brokerHandler.Data(path)
+	case ConstHandler:
+		return e.mapHandler
+	case FuncHandler:
+		dat, err := e.funcHandler(path)
+		if err != nil {
+			dat = make(map[string]interface{})
+			dat[ErrorKey] = err.Error()
+		}
+
+		return dat
+	case NilHandler:
+		return nil
+	default:
+		panic("gtemplate: broker: unknown handler type")
+	}
+}
+
+// lookupHandler traverses the handler stores and finds the chain of entries
+// which apply to pattern, least specific first, along with the parameters
+// captured if the most specific is parameterized. If none were found, or
+// pattern is empty, returns nil. The chain is built as follows:
 //
-// For files:
-//  1. Find the directory path (strip basename)
-//  2. For each component of directory (starting at longest), lookup in map
-//  3. If found for a component, first look for a match for whole file path
-//  4. If not found for entire file path, apply for directory instead
-func (b *Broker) lookupHandler(pattern string) (brokerEntry, bool) {
+//  1. The handler of each registered directory enclosing the path, from the
+//     root down
+//  2. The entry registered for exactly the path (see lookupExact) or, failing
+//     that, the most specific matching parameterized pattern or, failing
+//     that, the matching glob pattern with the longest literal prefix or,
+//     failing that, the first matching regular expression
+func (b *Broker) lookupHandler(pattern string) ([]brokerEntry, map[string]string) {
+	if pattern == "" {
+		return nil, nil
+	}
+
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	// Is a directory
-	if pattern[len(pattern)-1] == '/' {
-		if e, ok := b.reg[pattern]; ok {
-			if s, ok := e[pattern]; ok {
-				return s, true
-			}
-			if s, ok := e[path.Join(pattern, DirectoryIndex)]; ok {
-				return s, true
-			}
+	var chain []brokerEntry
+	for i := 0; i < len(pattern)-1; i++ {
+		if pattern[i] != '/' {
+			continue
 		}
-	} else {
-		comp := pattern
-		for comp != "/" {
-			// We have a file, so the basename will be stripped first iteration
-			comp = stringBacktrace(comp, "/")
-			if e, ok := b.reg[comp]; ok {
-				if s, ok := e[pattern]; ok {
-					return s, true
-				}
-
-				// No match for sub-path, return dir handler
-				return b.lookupHandler(comp)
+
+		dir := pattern[:i+1]
+		if s, ok := b.reg[dir][dir]; ok {
+			if s.noIndex && pattern == path.Join(dir, b.index()) {
+				continue
 			}
+			chain = append(chain, s)
+		}
+	}
 
-			comp = comp[:len(comp)-1]
+	if s, ok := b.lookupExact(pattern); ok {
+		// Automatic index handlers duplicate their enclosing directory's
+		if !s.autoIndex {
+			chain = append(chain, s)
 		}
+		return chain, nil
+	}
 
+	if e, params, ok := b.lookupParam(pattern); ok {
+		return append(chain, e.entry), params
+	}
+
+	for _, elem := range b.globs {
+		if elem.match(pattern) {
+			return append(chain, elem.entry), nil
+		}
+	}
+
+	for _, elem := range b.regex {
+		if params, ok := elem.match(pattern); ok {
+			return append(chain, elem.entry), params
+		}
+	}
+
+	return chain, nil
+}
+
+// HandlerFor reports the class of the most specific handler which applies to
+// path (see the handler type constants), and whether any does. Handlers of
+// enclosing directories apply to path, and so the class may be that of a
+// directory's handler. Handlers scoped to a method or host are not
+// considered. HandlerFor does not call any handler.
+func (b *Broker) HandlerFor(path string) (class int, ok bool) {
+	chain, _ := b.lookupHandler(path)
+	if len(chain) == 0 {
+		return NilHandler, false
+	}
+
+	return chain[len(chain)-1].class, true
+}
+
+// lookupParam finds the most specific parameterized pattern matching p.
+func (b *Broker) lookupParam(p string) (paramEntry, map[string]string, bool) {
+	for _, elem := range b.params {
+		if params, ok := elem.match(p); ok {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			return elem, params, true
+		}
+	}
+
+	return paramEntry{}, nil, false
+}
+
+// Route reports the parameterized pattern matched by path, if any, along with
+// the parameters captured from path. A TemplateServer uses Route to find the
+// template for a parameterized route, which is that at the pattern's path.
+func (b *Broker) Route(path string) (pattern string, params map[string]string, ok bool) {
+	if path == "" {
+		return "", nil, false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if _, ok := b.lookupExact(path); ok {
+		return "", nil, false
+	}
+
+	e, params, ok := b.lookupParam(path)
+	return e.pattern, params, ok
+}
+
+// lookupExact finds the entry registered for exactly pattern. For
+// directories, this is the directory's root handler, unless it does not
+// apply to the index, in which case it is the index's.
+func (b *Broker) lookupExact(pattern string) (brokerEntry, bool) {
+	dir := pattern
+	if pattern[len(pattern)-1] != '/' {
+		dir, _ = path.Split(pattern)
+	}
+
+	if e, ok := b.reg[dir]; ok {
+		// A directory without its index is instead looked up as the index
+		if s, ok := e[pattern]; ok && !s.noIndex {
+			return s, true
+		}
+		if dir == pattern {
+			if s, ok := e[path.Join(pattern, b.index())]; ok {
+				return s, true
+			}
+		}
 	}
 
-	// No match found whatsoever
 	return brokerEntry{}, false
 }
 
 func (b *Broker) registerHandler(pattern string, class int, handler interface{}) {
+	b.register(pattern, class, handler, true)
+}
+
+// register registers handler for pattern. If pattern is a directory, autoIndex
+// controls whether its handler applies to its index.
+func (b *Broker) register(pattern string, class int, handler interface{}, autoIndex bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	if pattern == "" {
 		panic("gtemplate: broker: empty pattern")
 	}
+	if !cleanPattern(pattern) {
+		panic("gtemplate: broker: unclean pattern")
+	}
 	if handler == nil {
 		panic("gtemplate: broker: nil handler")
 	}
 
+	// Initialized under the write lock, so concurrent first registrations
+	// cannot race to create the store
 	if b.reg == nil {
 		b.reg = make(map[string]map[string]brokerEntry)
 		b.reg["/"] = make(map[string]brokerEntry)
@@ -170,31 +578,62 @@ func (b *Broker) registerHandler(pattern string, class int, handler interface{})
 	// Main registration code
 	//
 	// If entry is a directory, first check if it exists. If so, panic
-	// Else, insert into hashmap with handler. Also provide handler for "index.gohtml"
+	// Else, insert into hashmap with handler. Also provide handler for the index
 	//
 	// If entry is a file, find directory in hashmap
 	// If not already present, create directory in hashmap
 	// Then, add as handler but *do not* insert default handlers
 	// If already present, simply append to existing slice
 	// If already in existing slice, panic
+	//
+	// If entry is a glob, insert into the glob list by specificity
+	// If already in the glob list, panic
+	//
+	// Parameterized entries are likewise kept in their own list
 
-	// Is directory
-	if pattern[len(pattern)-1] == '/' {
-		b.registerDirectory(pattern, entry)
-	} else {
+	switch {
+	case isParam(pattern):
+		b.registerParam(pattern, entry)
+	case isGlob(pattern):
+		b.registerGlob(pattern, entry)
+	case pattern[len(pattern)-1] == '/':
+		b.registerDirectory(pattern, entry, autoIndex)
+	default:
 		b.registerFile(pattern, entry)
 	}
 }
 
-func (b *Broker) registerDirectory(pattern string, entry brokerEntry) {
+// cleanPattern reports whether pattern is a clean path, but for a trailing
+// slash, without any ".." element, such that it cannot match outside of the
+// directory it names.
+func cleanPattern(pattern string) bool {
+	p := pattern
+	if p != "/" {
+		p = strings.TrimSuffix(p, "/")
+	}
+	if path.Clean(p) != p {
+		return false
+	}
+
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *Broker) registerDirectory(pattern string, entry brokerEntry, autoIndex bool) {
 	// Path already present
 	// Check for duplicates, then insert if all ok
-	needIndex := true
+	needIndex := autoIndex
+	entry.noIndex = !autoIndex
 	if m, ok := b.reg[pattern]; ok {
 		if _, ok := m[pattern]; ok {
 			panic("gtemplate: broker: attempted to re-register directory")
 		}
-		if _, ok := m[path.Join(pattern, DirectoryIndex)]; ok {
+		if _, ok := m[path.Join(pattern, b.index())]; ok {
 			needIndex = false
 		}
 	} else {
@@ -204,14 +643,15 @@ func (b *Broker) registerDirectory(pattern string, entry brokerEntry) {
 	// Add default entries
 	b.reg[pattern][pattern] = entry
 	if needIndex {
-		b.reg[pattern][path.Join(pattern, DirectoryIndex)] = entry
+		entry.autoIndex = true
+		b.reg[pattern][path.Join(pattern, b.index())] = entry
 	}
 }
 
 func (b *Broker) registerFile(pattern string, entry brokerEntry) {
 	dir, file := path.Split(pattern)
 
-	if file == DirectoryIndex {
+	if d, ok := b.reg[dir][dir]; file == b.index() && (!ok || !d.noIndex) {
 		panic("gtemplate: broker: attempted to register handler for index - use directory instead")
 	}
 
@@ -226,6 +666,217 @@ func (b *Broker) registerFile(pattern string, entry brokerEntry) {
 	b.reg[dir][pattern] = entry
 }
 
+func (b *Broker) registerParam(pattern string, entry brokerEntry) {
+	if isGlob(pattern) {
+		panic("gtemplate: broker: parameterized pattern contains glob")
+	}
+
+	e := paramEntry{
+		pattern:  pattern,
+		segments: strings.Split(strings.Trim(pattern, "/"), "/"),
+		dir:      pattern[len(pattern)-1] == '/',
+		entry:    entry,
+	}
+	for _, elem := range e.segments {
+		if elem == "" || strings.HasPrefix(elem, ":.") || elem == ":" {
+			panic("gtemplate: broker: malformed parameterized pattern")
+		}
+	}
+
+	// Keep most specific first, then by registration order
+	i := len(b.params)
+	for j, elem := range b.params {
+		if elem.pattern == pattern {
+			panic("gtemplate: broker: attempted to re-register parameterized pattern")
+		}
+		if i == len(b.params) && e.before(elem) {
+			i = j
+		}
+	}
+
+	b.params = append(b.params, paramEntry{})
+	copy(b.params[i+1:], b.params[i:])
+	b.params[i] = e
+}
+
+func (b *Broker) registerGlob(pattern string, entry brokerEntry) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic("gtemplate: broker: malformed glob pattern")
+	}
+
+	// Keep globs ordered by literal prefix length, longest first, then by
+	// registration order
+	g := globEntry{
+		pattern: pattern,
+		literal: strings.IndexAny(pattern, "*?["),
+		entry:   entry,
+	}
+	i := len(b.globs)
+	for j, elem := range b.globs {
+		if elem.pattern == pattern {
+			panic("gtemplate: broker: attempted to re-register glob")
+		}
+		if i == len(b.globs) && elem.literal < g.literal {
+			i = j
+		}
+	}
+
+	b.globs = append(b.globs, globEntry{})
+	copy(b.globs[i+1:], b.globs[i:])
+	b.globs[i] = g
+}
+
+// Remove unregisters the handler for pattern, reporting whether one had been
+// registered. Removing a directory also removes the handler automatically
+// registered for its index. Once removed, a pattern may be registered again.
+func (b *Broker) Remove(pattern string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if pattern == "" {
+		return false
+	}
+
+	if isParam(pattern) {
+		for i, elem := range b.params {
+			if elem.pattern == pattern {
+				b.params = append(b.params[:i], b.params[i+1:]...)
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if isGlob(pattern) {
+		for i, elem := range b.globs {
+			if elem.pattern == pattern {
+				b.globs = append(b.globs[:i], b.globs[i+1:]...)
+				return true
+			}
+		}
+
+		return false
+	}
+
+	dir := pattern
+	if pattern[len(pattern)-1] != '/' {
+		dir, _ = path.Split(pattern)
+	}
+
+	m, ok := b.reg[dir]
+	if !ok {
+		return false
+	}
+	if _, ok := m[pattern]; !ok {
+		return false
+	}
+
+	delete(m, pattern)
+	if dir == pattern {
+		index := path.Join(pattern, b.index())
+		if s, ok := m[index]; ok && s.autoIndex {
+			delete(m, index)
+		}
+	}
+	if len(m) == 0 && dir != "/" {
+		delete(b.reg, dir)
+	}
+
+	return true
+}
+
+// registration is a registered pattern, as reported by Walk.
+type registration struct {
+	method, host, pattern string
+	class                 int
+}
+
+// String returns the pattern as reported by Walk.
+func (r registration) String() string {
+	if r.method != "" {
+		return r.method + " " + r.host + r.pattern
+	}
+
+	return r.host + r.pattern
+}
+
+// registrations returns the patterns registered with b and its scoped
+// brokers, in no particular order.
+func (b *Broker) registrations() []registration {
+	b.mu.RLock()
+	var reg []registration
+	for _, m := range b.reg {
+		for pattern, e := range m {
+			if !e.autoIndex {
+				reg = append(reg, registration{pattern: pattern, class: e.class})
+			}
+		}
+	}
+	for _, elem := range b.params {
+		reg = append(reg, registration{pattern: elem.pattern, class: elem.entry.class})
+	}
+	for _, elem := range b.globs {
+		reg = append(reg, registration{pattern: elem.pattern, class: elem.entry.class})
+	}
+	for _, elem := range b.regex {
+		reg = append(reg, registration{pattern: elem.re.String(), class: elem.entry.class})
+	}
+	methods := make(map[string]*Broker, len(b.methods))
+	for method, mb := range b.methods {
+		methods[method] = mb
+	}
+	hosts := make(map[string]*Broker, len(b.hosts))
+	for host, hb := range b.hosts {
+		hosts[host] = hb
+	}
+	b.mu.RUnlock()
+
+	for method, mb := range methods {
+		for _, elem := range mb.registrations() {
+			elem.method = method
+			reg = append(reg, elem)
+		}
+	}
+	for host, hb := range hosts {
+		for _, elem := range hb.registrations() {
+			elem.host = host
+			reg = append(reg, elem)
+		}
+	}
+
+	return reg
+}
+
+// Walk calls fn for each registered pattern, sorted by pattern, reporting the
+// class of its handler (see the handler type constants). Regular expressions
+// are reported by their source text. Patterns scoped to a host are prefixed
+// by the host, and those scoped to a method by the method and a space, as in
+// "POST example.com/contact.gohtml". The registrations are read before any
+// call to fn, which may therefore safely use the broker itself.
+func (b *Broker) Walk(fn func(pattern string, class int)) {
+	reg := b.registrations()
+	sort.Slice(reg, func(i, j int) bool {
+		return reg[i].String() < reg[j].String()
+	})
+	for _, elem := range reg {
+		fn(elem.String(), elem.class)
+	}
+}
+
+// Reset unregisters all handlers.
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reg = nil
+	b.params = nil
+	b.globs = nil
+	b.regex = nil
+	b.methods = nil
+	b.hosts = nil
+}
+
 // Handle registers a DataBroker to handle data requests for a route.
 // Data requests are passed verbatim to this handler unchanged. What happens
 // from there is not our business.
@@ -241,6 +892,138 @@ func (b *Broker) HandleFunc(pattern string, handler BrokerFunc) {
 	b.registerHandler(pattern, FuncHandler, handler)
 }
 
+// HandleFuncDir registers a function to handle data requests for the
+// directory pattern, which must end in a slash, as HandleFunc. If autoIndex
+// is true, the handler also applies to the directory's index, as with
+// HandleFunc. If autoIndex is false, the handler applies only to the other
+// paths within the directory, and the index may then be given a handler of
+// its own, which must be registered after the directory's; otherwise,
+// registering a handler for an index panics. HandleFuncDir panics if
+// pattern is not a directory, if handler is nil or if pattern has already
+// been registered.
+func (b *Broker) HandleFuncDir(pattern string, handler BrokerFunc, autoIndex bool) {
+	if !strings.HasSuffix(pattern, "/") || isParam(pattern) || isGlob(pattern) {
+		panic("gtemplate: broker: HandleFuncDir requires a directory pattern")
+	}
+
+	b.register(pattern, FuncHandler, handler, autoIndex)
+}
+
+// HandleRegex registers a function which will be called to handle data
+// requests for paths matching the regular expression re. Regular expressions
+// are consulted only when no exact, parameterized or glob pattern matches,
+// in the order they were registered. The groups captured by re are added to
+// the data under ParamsKey, keyed by their index, such as "1", and also by
+// name for named groups. Note that re matches anywhere within the path unless
+// anchored, as in `^/posts/\d+\.gohtml$`.
+// HandleRegex panics if re or handler is nil or if an identical expression has
+// already been registered.
+func (b *Broker) HandleRegex(re *regexp.Regexp, handler BrokerFunc) {
+	if re == nil {
+		panic("gtemplate: broker: nil regular expression")
+	}
+	if handler == nil {
+		panic("gtemplate: broker: nil handler")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, elem := range b.regex {
+		if elem.re.String() == re.String() {
+			panic("gtemplate: broker: attempted to re-register regular expression")
+		}
+	}
+	b.regex = append(b.regex, regexEntry{
+		re:    re,
+		entry: brokerEntry{class: FuncHandler, funcHandler: handler},
+	})
+}
+
+// scoped returns the broker in the scope registry m for key, creating it if
+// necessary.
+func (b *Broker) scoped(m *map[string]*Broker, key string) *Broker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sb, ok := (*m)[key]
+	if !ok {
+		if *m == nil {
+			*m = make(map[string]*Broker)
+		}
+		sb = &Broker{Extension: b.Extension, Index: b.Index}
+		(*m)[key] = sb
+	}
+
+	return sb
+}
+
+// method returns the broker of the handlers scoped to method, creating it if
+// necessary.
+func (b *Broker) method(method string) *Broker {
+	if method == "" {
+		panic("gtemplate: broker: empty method")
+	}
+
+	return b.scoped(&b.methods, strings.ToUpper(method))
+}
+
+// Host returns the broker of the handlers scoped to requests for host, such
+// as "example.com", creating it if necessary. Any port is ignored, and host
+// names are compared case insensitively. Handlers may be registered on the
+// returned broker as on any other, including those scoped to a method. See
+// DataForRequest for how host-scoped handlers are chosen. Parameterized
+// patterns scoped to a host do not route requests to templates, and so
+// should also be registered for any host.
+func (b *Broker) Host(host string) *Broker {
+	host = hostname(host)
+	if host == "" {
+		panic("gtemplate: broker: empty host")
+	}
+
+	return b.scoped(&b.hosts, host)
+}
+
+// HandleHost registers a DataBroker to handle data requests for a route on
+// host. It is equivalent to Host(host).Handle(pattern, broker).
+func (b *Broker) HandleHost(host, pattern string, broker DataBroker) {
+	b.Host(host).Handle(pattern, broker)
+}
+
+// HandleFuncHost registers a function to handle data requests for a route on
+// host. It is equivalent to Host(host).HandleFunc(pattern, handler).
+func (b *Broker) HandleFuncHost(host, pattern string, handler BrokerFunc) {
+	b.Host(host).HandleFunc(pattern, handler)
+}
+
+// HandleDataHost registers a constant map to be returned on data requests for
+// a route on host. It is equivalent to Host(host).HandleData(pattern,
+// handler).
+func (b *Broker) HandleDataHost(host, pattern string, handler map[string]interface{}) {
+	b.Host(host).HandleData(pattern, handler)
+}
+
+// HandleMethod registers a DataBroker to handle data requests for a route
+// made with the HTTP method, such as "POST". See DataForRequest for how
+// method-scoped handlers are chosen, and Handle. Parameterized patterns
+// scoped to a method do not route requests to templates, and so should also
+// be registered for any method.
+func (b *Broker) HandleMethod(method, pattern string, broker DataBroker) {
+	b.method(method).Handle(pattern, broker)
+}
+
+// HandleFuncMethod registers a function to handle data requests for a route
+// made with the HTTP method. See HandleMethod and HandleFunc.
+func (b *Broker) HandleFuncMethod(method, pattern string, handler BrokerFunc) {
+	b.method(method).HandleFunc(pattern, handler)
+}
+
+// HandleDataMethod registers a constant map to be returned on data requests
+// for a route made with the HTTP method. See HandleMethod and HandleData.
+func (b *Broker) HandleDataMethod(method, pattern string, handler map[string]interface{}) {
+	b.method(method).HandleData(pattern, handler)
+}
+
 // HandleData registers a constant map which will be returned on requests for
 // data for a route. The map will be accessed concurrently and must not be
 // changed during execution. The best way to do this is to use a map literal.
@@ -261,8 +1044,20 @@ func HandleFunc(pattern string, handler BrokerFunc) {
 	DefaultDataBroker.HandleFunc(pattern, handler)
 }
 
+// HandleFuncDir registers a directory function handler for DefaultDataBroker.
+// See documentation for DataBroker.HandleFuncDir.
+func HandleFuncDir(pattern string, handler BrokerFunc, autoIndex bool) {
+	DefaultDataBroker.HandleFuncDir(pattern, handler, autoIndex)
+}
+
 // HandleData registers a function handler for DefaultDataBroker.
 // See documentation for DataBroker.HandleData.
 func HandleData(pattern string, handler map[string]interface{}) {
 	DefaultDataBroker.HandleData(pattern, handler)
 }
+
+// HandleRegex registers a regular expression handler for DefaultDataBroker.
+// See documentation for DataBroker.HandleRegex.
+func HandleRegex(re *regexp.Regexp, handler BrokerFunc) {
+	DefaultDataBroker.HandleRegex(re, handler)
+}
@@ -2,11 +2,21 @@ package gtemplate
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestDefaultBroker(t *testing.T) {
+	defer DefaultDataBroker.Reset()
+
 	broker := TestBroker{}
 	Handle("/", broker)
 	HandleData("/sub/", map[string]interface{}{
@@ -65,3 +75,626 @@ func BenchmarkHandlerLookup(b *testing.B) {
 		hndl.lookupHandler(path)
 	}
 }
+
+func TestBrokerGlob(t *testing.T) {
+	broker := NewBroker()
+	for _, elem := range []string{
+		"/blog/*.gohtml",
+		"/blog/p*.gohtml",
+		"/blog/exact.gohtml",
+		"/api/v*/",
+		"/*",
+	} {
+		broker.HandleData(elem, map[string]interface{}{
+			"pattern": elem,
+		})
+	}
+
+	paths := []struct {
+		path    string
+		pattern interface{}
+	}{
+		{"/blog/about.gohtml", "/blog/*.gohtml"},
+		{"/blog/post.gohtml", "/blog/p*.gohtml"},
+		{"/blog/exact.gohtml", "/blog/exact.gohtml"},
+		{"/blog/sub/post.gohtml", nil},
+		{"/api/v1/", "/api/v*/"},
+		{"/api/v2/users.gohtml", "/api/v*/"},
+		{"/api/other.gohtml", nil},
+		{"/index.gohtml", "/*"},
+	}
+
+	for _, elem := range paths {
+		got := broker.Data(elem.path)["pattern"]
+		if got != elem.pattern {
+			t.Errorf("glob %q: matched %v, expected %v", elem.path, got, elem.pattern)
+		}
+	}
+}
+
+func TestBrokerRemove(t *testing.T) {
+	broker := NewBroker()
+	for _, elem := range []string{"/", "/sub/", "/sub/a.gohtml", "/*.txt"} {
+		broker.HandleData(elem, map[string]interface{}{
+			"pattern": elem,
+		})
+	}
+
+	tests := []struct {
+		remove  string
+		removed bool
+		path    string
+		pattern interface{}
+	}{
+		{"/sub/a.gohtml", true, "/sub/a.gohtml", "/sub/"},
+		{"/sub/a.gohtml", false, "/sub/a.gohtml", "/sub/"},
+		{"/sub/", true, "/sub/index.gohtml", "/"},
+		{"/*.txt", true, "/robots.txt", "/"},
+		{"/notexist/", false, "/index.gohtml", "/"},
+		{"", false, "/index.gohtml", "/"},
+	}
+
+	for _, elem := range tests {
+		removed := broker.Remove(elem.remove)
+		if removed != elem.removed {
+			t.Errorf("remove %q: got %v, expected %v", elem.remove, removed, elem.removed)
+		}
+
+		got := broker.Data(elem.path)["pattern"]
+		if got != elem.pattern {
+			t.Errorf("remove %q: %q matched %v, expected %v", elem.remove, elem.path, got, elem.pattern)
+		}
+	}
+
+	// Removed patterns may be registered again without panicking
+	broker.HandleData("/sub/", map[string]interface{}{"pattern": "again"})
+	if got := broker.Data("/sub/index.gohtml")["pattern"]; got != "again" {
+		t.Errorf("re-register: got %v, expected again", got)
+	}
+
+	broker.Reset()
+	if dat := broker.Data("/index.gohtml"); dat != nil {
+		t.Errorf("reset: got %v, expected no data", dat)
+	}
+}
+
+func TestBrokerInheritance(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/", map[string]interface{}{
+		"site":  "gtemplate",
+		"title": "Home",
+	})
+	broker.HandleData("/blog/", map[string]interface{}{
+		"title":  "Blog",
+		"author": "Ethan Marshall",
+	})
+	broker.HandleFunc("/blog/post.gohtml", func(path string) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"title": "Post",
+		}, nil
+	})
+	broker.HandleData("/blog/drafts/draft.gohtml", map[string]interface{}{
+		"draft": true,
+	})
+
+	tests := []struct {
+		path string
+		data map[string]interface{}
+	}{
+		{"/index.gohtml", map[string]interface{}{"site": "gtemplate", "title": "Home"}},
+		{"/blog/", map[string]interface{}{"site": "gtemplate", "title": "Blog", "author": "Ethan Marshall"}},
+		{"/blog/index.gohtml", map[string]interface{}{"site": "gtemplate", "title": "Blog", "author": "Ethan Marshall"}},
+		{"/blog/post.gohtml", map[string]interface{}{"site": "gtemplate", "title": "Post", "author": "Ethan Marshall"}},
+		{"/blog/drafts/other.gohtml", map[string]interface{}{"site": "gtemplate", "title": "Blog", "author": "Ethan Marshall"}},
+		{"/blog/drafts/draft.gohtml", map[string]interface{}{"site": "gtemplate", "title": "Blog", "author": "Ethan Marshall", "draft": true}},
+	}
+
+	for _, elem := range tests {
+		got := broker.Data(elem.path)
+		if !reflect.DeepEqual(got, elem.data) {
+			t.Errorf("inherit %q: got %v, expected %v", elem.path, got, elem.data)
+		}
+	}
+}
+
+func TestBrokerParams(t *testing.T) {
+	broker := NewBroker()
+	for _, elem := range []string{
+		"/user/:id/profile.gohtml",
+		"/user/:id/:page.gohtml",
+		"/user/admin/:page.gohtml",
+		"/files/:bucket/",
+		"/*",
+	} {
+		broker.HandleData(elem, map[string]interface{}{
+			"pattern": elem,
+		})
+	}
+
+	tests := []struct {
+		path    string
+		pattern interface{}
+		params  map[string]string
+	}{
+		{"/user/42/profile.gohtml", "/user/:id/profile.gohtml", map[string]string{"id": "42"}},
+		{"/user/42/posts.gohtml", "/user/:id/:page.gohtml", map[string]string{"id": "42", "page": "posts"}},
+		{"/user/admin/profile.gohtml", "/user/admin/:page.gohtml", map[string]string{"page": "profile"}},
+		{"/user//profile.gohtml", nil, nil},
+		{"/user/42/sub/profile.gohtml", nil, nil},
+		{"/files/photos/", "/files/:bucket/", map[string]string{"bucket": "photos"}},
+		{"/files/photos/cat.gohtml", "/files/:bucket/", map[string]string{"bucket": "photos"}},
+		{"/index.gohtml", "/*", nil},
+	}
+
+	for _, elem := range tests {
+		dat := broker.Data(elem.path)
+		if got := dat["pattern"]; got != elem.pattern {
+			t.Errorf("params %q: matched %v, expected %v", elem.path, got, elem.pattern)
+		}
+
+		params, _ := dat[ParamsKey].(map[string]string)
+		if !reflect.DeepEqual(params, elem.params) {
+			t.Errorf("params %q: got %v, expected %v", elem.path, params, elem.params)
+		}
+	}
+
+	if !broker.Remove("/user/:id/profile.gohtml") {
+		t.Errorf("params: failed to remove parameterized pattern")
+	}
+	if got := broker.Data("/user/42/profile.gohtml")["pattern"]; got != "/user/:id/:page.gohtml" {
+		t.Errorf("params: matched %v after removal", got)
+	}
+}
+
+func TestServerParams(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file names cannot contain colons")
+	}
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "user", ":id"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	page := `<p>Profile of {{.name}} ({{.params.id}})</p>`
+	if err := os.WriteFile(filepath.Join(root, "user", ":id", "profile.gohtml"), []byte(page), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	broker := NewBroker()
+	broker.HandleFunc("/user/:id/profile.gohtml", func(path string) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"name": "user at " + path,
+		}, nil
+	})
+
+	srv, err := NewServer(root, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/user/42/profile.gohtml", http.StatusOK, "<p>Profile of user at /user/42/profile.gohtml (42)</p>"},
+		{"/user/7/profile", http.StatusOK, "<p>Profile of user at /user/7/profile.gohtml (7)</p>"},
+		{"/user/42/other.gohtml", http.StatusNotFound, ""},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.code {
+			t.Errorf("server params %q: got status %d, expected %d", elem.path, w.Code, elem.code)
+		}
+		if elem.body != "" && w.Body.String() != elem.body {
+			t.Errorf("server params %q: got body %q, expected %q", elem.path, w.Body.String(), elem.body)
+		}
+	}
+}
+
+func TestBrokerRegex(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/posts/latest.gohtml", map[string]interface{}{
+		"pattern": "exact",
+	})
+	broker.HandleData("/posts/draft-*.gohtml", map[string]interface{}{
+		"pattern": "glob",
+	})
+	broker.HandleRegex(regexp.MustCompile(`^/posts/(?P<id>\d+)\.gohtml$`), func(path string) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"pattern": "numeric",
+		}, nil
+	})
+	broker.HandleRegex(regexp.MustCompile(`^/posts/(\w+)\.gohtml$`), func(path string) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"pattern": "word",
+		}, nil
+	})
+
+	tests := []struct {
+		path    string
+		pattern interface{}
+		params  map[string]string
+	}{
+		{"/posts/42.gohtml", "numeric", map[string]string{"1": "42", "id": "42"}},
+		{"/posts/hello.gohtml", "word", map[string]string{"1": "hello"}},
+		{"/posts/latest.gohtml", "exact", nil},
+		{"/posts/draft-1.gohtml", "glob", nil},
+		{"/posts/42/comments.gohtml", nil, nil},
+	}
+
+	for _, elem := range tests {
+		dat := broker.Data(elem.path)
+		if got := dat["pattern"]; got != elem.pattern {
+			t.Errorf("regex %q: matched %v, expected %v", elem.path, got, elem.pattern)
+		}
+
+		params, _ := dat[ParamsKey].(map[string]string)
+		if !reflect.DeepEqual(params, elem.params) {
+			t.Errorf("regex %q: got params %v, expected %v", elem.path, params, elem.params)
+		}
+	}
+}
+
+func TestBrokerWalk(t *testing.T) {
+	broker := NewBroker()
+	broker.Handle("/", TestBroker{})
+	broker.HandleData("/sub/", map[string]interface{}{})
+	broker.HandleFunc("/sub/a.gohtml", func(path string) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	broker.HandleData("/user/:id/", map[string]interface{}{})
+	broker.HandleData("/*.txt", map[string]interface{}{})
+	broker.HandleRegex(regexp.MustCompile(`^/posts/\d+$`), func(path string) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	type registration struct {
+		pattern string
+		class   int
+	}
+	var got []registration
+	broker.Walk(func(pattern string, class int) {
+		got = append(got, registration{pattern, class})
+	})
+
+	expected := []registration{
+		{"/", BrokerHandler},
+		{"/*.txt", ConstHandler},
+		{"/sub/", ConstHandler},
+		{"/sub/a.gohtml", FuncHandler},
+		{"/user/:id/", ConstHandler},
+		{`^/posts/\d+$`, FuncHandler},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("walk: got %v, expected %v", got, expected)
+	}
+}
+
+func TestBrokerEmptyPath(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/", map[string]interface{}{
+		"pattern": "/",
+	})
+	broker.HandleData("/user/:id/", map[string]interface{}{})
+
+	if dat := broker.Data(""); dat != nil {
+		t.Errorf("empty path: got %v, expected nil", dat)
+	}
+	if _, _, ok := broker.Route(""); ok {
+		t.Errorf("empty path: matched a route")
+	}
+}
+
+func TestBrokerMethods(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/", map[string]interface{}{
+		"handler": "any",
+	})
+	broker.HandleFuncMethod("get", "/contact.gohtml", func(path string) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"handler": "get",
+		}, nil
+	})
+	broker.HandleFuncMethod("POST", "/contact.gohtml", func(path string) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"handler": "post",
+		}, nil
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		expect string
+	}{
+		{"GET", "/contact.gohtml", "get"},
+		{"HEAD", "/contact.gohtml", "get"},
+		{"POST", "/contact.gohtml", "post"},
+		{"PUT", "/contact.gohtml", "any"},
+		{"POST", "/other.gohtml", "any"},
+	}
+
+	for _, elem := range tests {
+		dat := broker.DataForRequest(httptest.NewRequest(elem.method, elem.path, nil))
+		if dat["handler"] != elem.expect {
+			t.Errorf("methods %s %q: got handler %v, expected %q", elem.method, elem.path, dat["handler"], elem.expect)
+		}
+	}
+
+	var patterns []string
+	broker.Walk(func(pattern string, class int) {
+		patterns = append(patterns, pattern)
+	})
+	expected := []string{"/", "GET /contact.gohtml", "POST /contact.gohtml"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("methods walk: got %q, expected %q", patterns, expected)
+	}
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "contact.gohtml"), []byte("{{.handler}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(root, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.AnyMethod = true
+
+	for _, method := range []string{"GET", "POST"} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(method, "/contact.gohtml", nil))
+		if expect := strings.ToLower(method); w.Body.String() != expect {
+			t.Errorf("server methods %s: got body %q, expected %q", method, w.Body.String(), expect)
+		}
+	}
+}
+
+func TestBrokerHosts(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/", map[string]interface{}{
+		"site": "default",
+	})
+	broker.HandleDataHost("example.com", "/", map[string]interface{}{
+		"site": "example.com",
+	})
+	broker.HandleDataHost("Example.ORG", "/news/", map[string]interface{}{
+		"site": "example.org",
+	})
+	broker.Host("example.org").HandleDataMethod("POST", "/news/", map[string]interface{}{
+		"site": "example.org post",
+	})
+
+	tests := []struct {
+		method string
+		host   string
+		path   string
+		expect string
+	}{
+		{"GET", "example.com", "/index.gohtml", "example.com"},
+		{"GET", "example.com:8080", "/news/index.gohtml", "example.com"},
+		{"GET", "example.org", "/news/index.gohtml", "example.org"},
+		{"POST", "example.org", "/news/index.gohtml", "example.org post"},
+		{"GET", "EXAMPLE.ORG.", "/news/index.gohtml", "example.org"},
+		{"GET", "example.org", "/index.gohtml", "default"},
+		{"GET", "example.net", "/news/index.gohtml", "default"},
+	}
+
+	for _, elem := range tests {
+		r := httptest.NewRequest(elem.method, elem.path, nil)
+		r.Host = elem.host
+
+		dat := broker.DataForRequest(r)
+		if dat["site"] != elem.expect {
+			t.Errorf("hosts %s %s%s: got site %v, expected %q", elem.method, elem.host, elem.path, dat["site"], elem.expect)
+		}
+	}
+
+	var patterns []string
+	broker.Walk(func(pattern string, class int) {
+		patterns = append(patterns, pattern)
+	})
+	expected := []string{"/", "POST example.org/news/", "example.com/", "example.org/news/"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("hosts walk: got %q, expected %q", patterns, expected)
+	}
+}
+
+func TestBrokerHandlerFor(t *testing.T) {
+	broker := NewBroker()
+	broker.Handle("/", TestBroker{})
+	broker.HandleData("/sub/", map[string]interface{}{})
+	broker.HandleFunc("/sub/a.gohtml", func(path string) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	broker.HandleData("/user/:id/profile.gohtml", map[string]interface{}{})
+
+	tests := []struct {
+		path  string
+		class int
+		ok    bool
+	}{
+		{"/index.gohtml", BrokerHandler, true},
+		{"/other.gohtml", BrokerHandler, true},
+		{"/sub/a.gohtml", FuncHandler, true},
+		{"/sub/b.gohtml", ConstHandler, true},
+		{"/sub/index.gohtml", ConstHandler, true},
+		{"/user/42/profile.gohtml", ConstHandler, true},
+		{"", NilHandler, false},
+	}
+
+	for _, elem := range tests {
+		class, ok := broker.HandlerFor(elem.path)
+		if class != elem.class || ok != elem.ok {
+			t.Errorf("handler for %q: got %d, %t, expected %d, %t", elem.path, class, ok, elem.class, elem.ok)
+		}
+	}
+
+	if class, ok := NewBroker().HandlerFor("/index.gohtml"); class != NilHandler || ok {
+		t.Errorf("handler for empty broker: got %d, %t, expected %d, false", class, ok, NilHandler)
+	}
+}
+
+func TestBrokerHandleFuncDir(t *testing.T) {
+	dirFunc := func(path string) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"handler": "dir",
+		}, nil
+	}
+
+	broker := NewBroker()
+	broker.HandleFuncDir("/blog/", dirFunc, false)
+	broker.HandleData("/blog/index.gohtml", map[string]interface{}{
+		"index": true,
+	})
+	broker.HandleFuncDir("/docs/", dirFunc, false)
+	broker.HandleFuncDir("/news/", dirFunc, true)
+
+	tests := []struct {
+		path   string
+		expect map[string]interface{}
+	}{
+		{"/blog/post.gohtml", map[string]interface{}{"handler": "dir"}},
+		{"/blog/index.gohtml", map[string]interface{}{"index": true}},
+		{"/blog/", map[string]interface{}{"index": true}},
+		{"/docs/page.gohtml", map[string]interface{}{"handler": "dir"}},
+		{"/docs/index.gohtml", nil},
+		{"/news/index.gohtml", map[string]interface{}{"handler": "dir"}},
+	}
+
+	for _, elem := range tests {
+		dat := broker.Data(elem.path)
+		delete(dat, "path")
+		if len(dat) == 0 && len(elem.expect) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(dat, elem.expect) {
+			t.Errorf("handle func dir %q: got %v, expected %v", elem.path, dat, elem.expect)
+		}
+	}
+
+	panics := []struct {
+		name string
+		fn   func()
+	}{
+		{"auto index", func() { broker.HandleData("/news/index.gohtml", map[string]interface{}{}) }},
+		{"unregistered directory", func() { broker.HandleData("/other/index.gohtml", map[string]interface{}{}) }},
+		{"file pattern", func() { broker.HandleFuncDir("/file.gohtml", dirFunc, false) }},
+	}
+	for _, elem := range panics {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("handle func dir %s: expected panic", elem.name)
+				}
+			}()
+			elem.fn()
+		}()
+	}
+}
+
+func TestBrokerUncleanPattern(t *testing.T) {
+	patterns := []string{
+		"/../secret.gohtml",
+		"/blog/../admin/",
+		"/blog/./post.gohtml",
+		"/blog//post.gohtml",
+		"/blog//",
+		"/../*.gohtml",
+		"/user/:id/../",
+	}
+
+	for _, elem := range patterns {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("unclean pattern %q: expected panic", elem)
+				}
+			}()
+			NewBroker().HandleData(elem, map[string]interface{}{})
+		}()
+	}
+
+	broker := NewBroker()
+	for _, elem := range []string{"/", "/blog/", "/blog/post.gohtml", "/user/:id/", "/*.gohtml"} {
+		broker.HandleData(elem, map[string]interface{}{})
+	}
+}
+
+func TestBrokerAdopt(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/blog/", map[string]interface{}{"section": "blog"})
+	broker.HandleFuncDir("/news/", func(path string) (map[string]interface{}, error) {
+		return map[string]interface{}{"section": "news"}, nil
+	}, false)
+	broker.HandleDataMethod("POST", "/blog/", map[string]interface{}{"posted": true})
+	broker.adopt(".tmpl", "home.tmpl")
+
+	if dat := broker.Data("/news/home.tmpl"); dat["section"] != nil {
+		t.Errorf("adopt: got %v for index of news, expected no directory data", dat)
+	}
+	if dat := broker.Data("/blog/home.tmpl"); dat["section"] != "blog" {
+		t.Errorf("adopt: got %v for index of blog, expected directory data", dat)
+	}
+	if broker.method("POST").index() != "home.tmpl" {
+		t.Errorf("adopt: got index %q for method broker, expected %q", broker.method("POST").index(), "home.tmpl")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("adopt: registering index of blog did not panic")
+			}
+		}()
+		broker.HandleData("/blog/home.tmpl", map[string]interface{}{})
+	}()
+
+	// Settings of the broker's own are kept
+	broker = &Broker{Extension: ".html"}
+	broker.adopt(".tmpl", "home.tmpl")
+	if broker.index() != "index.html" {
+		t.Errorf("adopt: got index %q, expected %q", broker.index(), "index.html")
+	}
+}
+
+func TestBrokerConcurrentRegistration(t *testing.T) {
+	const n = 64
+
+	broker := NewBroker()
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+
+			id := strconv.Itoa(i)
+			dat := map[string]interface{}{"id": id}
+			broker.HandleData("/dir"+id+"/", dat)
+			broker.HandleData("/dir"+id+"/file.gohtml", dat)
+			broker.HandleData("/file"+id+".gohtml", dat)
+			broker.HandleData("/*."+id, dat)
+			broker.HandleDataMethod("POST", "/post"+id+".gohtml", dat)
+			broker.HandleDataHost("host"+id+".example.com", "/", dat)
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+
+	count := 0
+	broker.Walk(func(pattern string, class int) {
+		count++
+	})
+	if count != n*6 {
+		t.Errorf("concurrent registration: got %d patterns, expected %d", count, n*6)
+	}
+
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		for _, p := range []string{"/dir" + id + "/", "/dir" + id + "/file.gohtml", "/file" + id + ".gohtml", "/x." + id} {
+			if dat := broker.Data(p); dat["id"] != id {
+				t.Errorf("concurrent registration %q: got id %v, expected %q", p, dat["id"], id)
+			}
+		}
+	}
+}
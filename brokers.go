@@ -0,0 +1,355 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// JSONBroker errors.
+var (
+	ErrUpstreamStatus = errors.New("gtemplate: json broker: unexpected upstream status")
+)
+
+// JSONBroker is a DataBroker which fetches the data for each path from an
+// upstream HTTP API returning a JSON object. The response body is decoded in
+// full into the data map before the template is executed, and so must fit in
+// memory; it is not streamed to the template.
+//
+// If the request or decoding fails, Data returns a map with only one entry
+// "error" set to the error encountered, matching the behaviour of BrokerFunc.
+type JSONBroker struct {
+	// Client is used to make upstream requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// URL maps a requested path to the upstream URL to fetch.
+	URL func(path string) string
+}
+
+// NewJSONBroker returns a JSONBroker which fetches data from the URL returned
+// by url for each requested path, using http.DefaultClient.
+func NewJSONBroker(url func(path string) string) *JSONBroker {
+	return &JSONBroker{URL: url}
+}
+
+func (b *JSONBroker) fetch(ctx context.Context, path string) (map[string]interface{}, error) {
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", b.URL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, ErrUpstreamStatus
+	}
+
+	dat := make(map[string]interface{})
+	err = json.NewDecoder(resp.Body).Decode(&dat)
+	if err != nil {
+		return nil, err
+	}
+
+	return dat, nil
+}
+
+func (b *JSONBroker) Data(path string) map[string]interface{} {
+	return b.DataCtx(context.Background(), path)
+}
+
+// DataCtx is like Data, but abandons the upstream request if ctx is
+// cancelled.
+func (b *JSONBroker) DataCtx(ctx context.Context, path string) map[string]interface{} {
+	dat, err := b.fetch(ctx, path)
+	if err != nil {
+		return map[string]interface{}{
+			ErrorKey: err.Error(),
+		}
+	}
+
+	return dat
+}
+
+// A CachingBroker is a DataBroker which caches the results of another broker
+// per path. Only successful results are cached for TTL. A nil map, or one
+// containing the "error" key set by a failing BrokerFunc or JSONBroker, is
+// treated as a failure and is never cached unless NegativeTTL is set, so the
+// next request for that path tries the underlying broker again.
+type CachingBroker struct {
+	// Broker is the underlying broker whose results are cached.
+	Broker DataBroker
+
+	// TTL is how long a successful result remains cached. Zero means
+	// results are cached forever.
+	TTL time.Duration
+
+	// NegativeTTL, if positive, is how long a failed result is cached
+	// before the underlying broker is tried again. This avoids a stampede
+	// of calls to a persistently failing backend.
+	NegativeTTL time.Duration
+
+	mut   sync.RWMutex // protects cache
+	cache map[string]cacheEntry
+}
+
+// CachedBroker returns a CachingBroker which caches the successful results of
+// inner for ttl. A zero ttl caches results forever.
+func CachedBroker(inner DataBroker, ttl time.Duration) *CachingBroker {
+	return &CachingBroker{Broker: inner, TTL: ttl}
+}
+
+type cacheEntry struct {
+	data    map[string]interface{}
+	expires time.Time // zero if the entry never expires
+}
+
+// failed reports whether dat is the result of a failed data request.
+func failed(dat map[string]interface{}) bool {
+	if dat == nil {
+		return true
+	}
+
+	_, ok := dat[ErrorKey]
+	return ok
+}
+
+func (b *CachingBroker) Data(path string) map[string]interface{} {
+	return b.DataCtx(context.Background(), path)
+}
+
+// DataCtx is like Data, but passes ctx to the underlying broker on a cache
+// miss if it is a ContextDataBroker.
+func (b *CachingBroker) DataCtx(ctx context.Context, path string) map[string]interface{} {
+	return b.cached(path, func() map[string]interface{} {
+		return contextData(ctx, b.Broker, path)
+	})
+}
+
+// DataForRequest is like DataCtx, but if the underlying broker is a
+// RequestDataBroker, such as a Broker with handlers scoped to methods or
+// hosts, passes r to it on a cache miss, and caches its results by the
+// method and host of r as well as the path. Results are not cached by any
+// other part of the request, so a RequestDataBroker whose data depends on
+// the query string, cookies or headers must not be wrapped.
+func (b *CachingBroker) DataForRequest(r *http.Request) map[string]interface{} {
+	rb, ok := b.Broker.(RequestDataBroker)
+	if !ok {
+		return b.DataCtx(r.Context(), r.URL.Path)
+	}
+
+	// Paths always begin with a slash, so never collide with these keys
+	key := r.Method + " " + hostname(r.Host) + r.URL.Path
+	return b.cached(key, func() map[string]interface{} {
+		return rb.DataForRequest(r)
+	})
+}
+
+// cached returns the result cached under key, calling fetch to fetch and
+// cache it if missing or expired.
+func (b *CachingBroker) cached(key string, fetch func() map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+
+	b.mut.RLock()
+	e, ok := b.cache[key]
+	b.mut.RUnlock()
+	if ok && (e.expires.IsZero() || now.Before(e.expires)) {
+		return e.data
+	}
+
+	dat := fetch()
+
+	ttl := b.TTL
+	if failed(dat) {
+		if b.NegativeTTL <= 0 {
+			return dat
+		}
+		ttl = b.NegativeTTL
+	}
+
+	e = cacheEntry{data: dat}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+
+	b.mut.Lock()
+	if b.cache == nil {
+		b.cache = make(map[string]cacheEntry)
+	}
+	b.cache[key] = e
+	b.mut.Unlock()
+
+	return dat
+}
+
+// Flush discards all cached results, so that the next request for each path
+// calls the underlying broker again.
+func (b *CachingBroker) Flush() {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	b.cache = nil
+}
+
+// A FileDataBroker is a DataBroker which reads the data for each path from a
+// JSON file alongside it in a data root, named for the path with ".data"
+// appended, such that the data for "/blog/post.gohtml" is read from
+// "blog/post.gohtml.data". Each file is read once and then cached until
+// Flush is called.
+//
+// If a path has no data file, Data returns nil, and the file is looked for
+// again on the next request. If the file cannot be read or decoded, Data
+// returns a map with only one entry "error" set to the error encountered,
+// matching the behaviour of BrokerFunc, and the result is not cached.
+type FileDataBroker struct {
+	// Root is the directory in which data files are found.
+	Root string
+
+	mut   sync.RWMutex // protects cache
+	cache map[string]map[string]interface{}
+}
+
+// NewFileDataBroker returns a FileDataBroker reading data files from the
+// directory dataRoot.
+func NewFileDataBroker(dataRoot string) *FileDataBroker {
+	return &FileDataBroker{Root: dataRoot}
+}
+
+func (b *FileDataBroker) Data(p string) map[string]interface{} {
+	b.mut.RLock()
+	dat, ok := b.cache[p]
+	b.mut.RUnlock()
+	if ok {
+		return dat
+	}
+
+	buf, err := os.ReadFile(filepath.Join(b.Root, filepath.FromSlash(path.Clean("/"+p))+".data"))
+	if err == nil {
+		err = json.Unmarshal(buf, &dat)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return map[string]interface{}{
+			ErrorKey: err.Error(),
+		}
+	}
+
+	b.mut.Lock()
+	if b.cache == nil {
+		b.cache = make(map[string]map[string]interface{})
+	}
+	b.cache[p] = dat
+	b.mut.Unlock()
+
+	return dat
+}
+
+// Flush discards all cached data, so that each data file is read afresh on
+// its next request.
+func (b *FileDataBroker) Flush() {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	b.cache = nil
+}
+
+// TypedBroker is an AnyDataBroker which supplies a value of type T, such as a
+// struct, as the root data of each template, so that templates may access
+// its fields as {{.Field}} with type safety in Go. The function is called
+// with the path of the template being served.
+//
+// The value is only used when the TypedBroker is the server's broker itself,
+// rather than wrapped by another broker.
+type TypedBroker[T any] func(path string) T
+
+// NewTypedBroker returns a TypedBroker calling fn, inferring T.
+func NewTypedBroker[T any](fn func(path string) T) TypedBroker[T] {
+	return TypedBroker[T](fn)
+}
+
+// Data returns nil, as the server calls AnyData instead.
+func (b TypedBroker[T]) Data(path string) map[string]interface{} {
+	return nil
+}
+
+// AnyData returns the value for path.
+func (b TypedBroker[T]) AnyData(path string) interface{} {
+	return b(path)
+}
+
+// multiBroker is the DataBroker returned by MultiBroker.
+type multiBroker []DataBroker
+
+// MultiBroker returns a DataBroker which merges the data of each of brokers,
+// in order. Keys from later brokers override those from earlier ones, and
+// brokers returning a nil map are skipped. Context and the request are passed
+// through to any underlying ContextDataBroker or RequestDataBroker.
+func MultiBroker(brokers ...DataBroker) DataBroker {
+	b := make(multiBroker, len(brokers))
+	copy(b, brokers)
+	return b
+}
+
+// merge merges the data returned by fetch for each broker.
+func (b multiBroker) merge(fetch func(DataBroker) map[string]interface{}) map[string]interface{} {
+	var dat map[string]interface{}
+	for _, elem := range b {
+		m := fetch(elem)
+		if m == nil {
+			continue
+		}
+		if dat == nil {
+			dat = make(map[string]interface{}, len(m))
+		}
+		for k, v := range m {
+			dat[k] = v
+		}
+	}
+
+	return dat
+}
+
+func (b multiBroker) Data(path string) map[string]interface{} {
+	return b.merge(func(broker DataBroker) map[string]interface{} {
+		return broker.Data(path)
+	})
+}
+
+// DataCtx is like Data, but passes ctx to each underlying ContextDataBroker.
+func (b multiBroker) DataCtx(ctx context.Context, path string) map[string]interface{} {
+	return b.merge(func(broker DataBroker) map[string]interface{} {
+		return contextData(ctx, broker, path)
+	})
+}
+
+// DataForRequest is like Data, but passes r to each underlying
+// RequestDataBroker.
+func (b multiBroker) DataForRequest(r *http.Request) map[string]interface{} {
+	return b.merge(func(broker DataBroker) map[string]interface{} {
+		if rb, ok := broker.(RequestDataBroker); ok {
+			return rb.DataForRequest(r)
+		}
+
+		return contextData(r.Context(), broker, r.URL.Path)
+	})
+}
@@ -0,0 +1,276 @@
+package gtemplate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestJSONBroker(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pages/index.gohtml" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"title": "Fetched from upstream", "author": "api", "date": 2022}`))
+	}))
+	defer api.Close()
+
+	broker := NewJSONBroker(func(path string) string {
+		return api.URL + "/pages" + path
+	})
+
+	srv, err := NewServer(TestDocumentRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "<title>Fetched from upstream</title>") {
+		t.Errorf("json broker: page %q missing fetched title", w.Body.String())
+	}
+
+	dat := broker.Data("/missing.gohtml")
+	if dat["error"] != ErrUpstreamStatus.Error() {
+		t.Errorf("json broker: got %v for missing page, expected upstream status error", dat)
+	}
+}
+
+// CountingBroker counts calls to Data, failing for paths in fail.
+type CountingBroker struct {
+	calls map[string]int
+	fail  map[string]bool
+}
+
+func (b *CountingBroker) Data(path string) map[string]interface{} {
+	b.calls[path]++
+	if b.fail[path] {
+		return map[string]interface{}{
+			"error": "backend unavailable",
+		}
+	}
+
+	return map[string]interface{}{
+		"calls": b.calls[path],
+	}
+}
+
+func TestCachingBroker(t *testing.T) {
+	tests := []struct {
+		path     string
+		ttl      time.Duration
+		negative time.Duration
+		wait     time.Duration
+		calls    int
+	}{
+		// Successful results are cached, forever with a zero TTL
+		{"/ok.gohtml", 0, 0, 0, 1},
+		{"/ok.gohtml", 0, 0, 50 * time.Millisecond, 1},
+		{"/ok.gohtml", time.Hour, 0, 0, 1},
+		{"/ok.gohtml", 10 * time.Millisecond, 0, 50 * time.Millisecond, 2},
+		// Failures are never cached without a negative TTL
+		{"/fail.gohtml", time.Hour, 0, 0, 2},
+		// Negative caching is bounded by the negative TTL
+		{"/fail.gohtml", time.Hour, time.Hour, 0, 1},
+		{"/fail.gohtml", time.Hour, 10 * time.Millisecond, 50 * time.Millisecond, 2},
+	}
+
+	for _, elem := range tests {
+		inner := &CountingBroker{
+			calls: make(map[string]int),
+			fail:  map[string]bool{"/fail.gohtml": true},
+		}
+		broker := &CachingBroker{
+			Broker:      inner,
+			TTL:         elem.ttl,
+			NegativeTTL: elem.negative,
+		}
+
+		broker.Data(elem.path)
+		time.Sleep(elem.wait)
+		broker.Data(elem.path)
+
+		if inner.calls[elem.path] != elem.calls {
+			t.Errorf("caching broker %q (ttl %s, negative %s, wait %s): got %d calls, expected %d",
+				elem.path, elem.ttl, elem.negative, elem.wait, inner.calls[elem.path], elem.calls)
+		}
+	}
+}
+
+func TestCachedBrokerFlush(t *testing.T) {
+	inner := &CountingBroker{calls: make(map[string]int)}
+	broker := CachedBroker(inner, 0)
+
+	broker.Data("/ok.gohtml")
+	broker.Data("/ok.gohtml")
+	if inner.calls["/ok.gohtml"] != 1 {
+		t.Errorf("cached broker: got %d calls before flush, expected 1", inner.calls["/ok.gohtml"])
+	}
+
+	broker.Flush()
+	if dat := broker.Data("/ok.gohtml"); dat["calls"] != 2 {
+		t.Errorf("cached broker: got %v after flush, expected fresh data", dat)
+	}
+}
+
+func TestCachedBrokerRequest(t *testing.T) {
+	inner := NewBroker()
+	inner.HandleData("/form.gohtml", map[string]interface{}{"title": "Form"})
+	inner.HandleDataMethod("POST", "/form.gohtml", map[string]interface{}{"title": "Submitted"})
+	inner.HandleDataHost("example.org", "/form.gohtml", map[string]interface{}{"title": "Example"})
+
+	broker := CachedBroker(inner, 0)
+	tests := []struct {
+		method, url string
+		title       string
+	}{
+		{"GET", "http://localhost/form.gohtml", "Form"},
+		{"POST", "http://localhost/form.gohtml", "Submitted"},
+		{"GET", "http://example.org/form.gohtml", "Example"},
+		{"GET", "http://localhost/form.gohtml", "Form"},
+		{"POST", "http://localhost/form.gohtml", "Submitted"},
+	}
+	for _, elem := range tests {
+		r := httptest.NewRequest(elem.method, elem.url, nil)
+		if got := broker.DataForRequest(r)["title"]; got != elem.title {
+			t.Errorf("cached broker %s %s: got title %v, expected %q", elem.method, elem.url, got, elem.title)
+		}
+	}
+
+	var rb RequestDataBroker = broker
+	if dat := rb.DataForRequest(httptest.NewRequest("GET", "/missing.gohtml", nil)); dat != nil {
+		t.Errorf("cached broker: got %v for missing path, expected nil", dat)
+	}
+}
+
+func TestMultiBroker(t *testing.T) {
+	site := NewBroker()
+	site.HandleData("/", map[string]interface{}{
+		"title": "Site",
+		"date":  2022,
+	})
+	empty := NewBroker()
+
+	broker := MultiBroker(site, empty, TestRequestBroker{})
+
+	dat := broker.Data("/index.gohtml")
+	if dat["title"] != "My Page" || dat["author"] != "Ethan Marshall" || dat["date"] == 2022 {
+		t.Errorf("multi broker: got %v, expected later brokers to override", dat)
+	}
+
+	if dat := MultiBroker(empty).Data("/index.gohtml"); dat != nil {
+		t.Errorf("multi broker: got %v from only nil maps, expected nil", dat)
+	}
+
+	srv, err := NewServer(TestDocumentRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/?lang=fr", nil))
+	if !strings.Contains(w.Body.String(), "<title>Page in fr</title>") {
+		t.Errorf("multi broker: body %q missing request dependent title", w.Body.String())
+	}
+}
+
+func TestTypedBroker(t *testing.T) {
+	type page struct {
+		Title string
+		Tags  []string
+	}
+
+	fsys := fstest.MapFS{
+		"site/index.gohtml": {Data: []byte(`{{.Title}}:{{range .Tags}} {{.}}{{end}}`)},
+		"site/field.gohtml": {Data: []byte(`{{.Author}}`)},
+	}
+	broker := NewTypedBroker(func(path string) page {
+		return page{Title: "Page " + path, Tags: []string{"go", "web"}}
+	})
+
+	srv, err := NewServerFS(fsys, "site", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if expected := "Page /index.gohtml: go web"; w.Body.String() != expected {
+		t.Errorf("typed broker: got %q, expected %q", w.Body.String(), expected)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/field.gohtml", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("typed broker: got %d for unknown field, expected %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestFileDataBroker(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"index.gohtml.data":     `{"title": "Home"}`,
+		"blog/post.gohtml.data": `{"title": "Post"}`,
+		"broken.gohtml.data":    `{"title": `,
+	}
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broker := NewFileDataBroker(root)
+	tests := []struct {
+		path  string
+		title interface{}
+		err   bool
+	}{
+		{"/index.gohtml", "Home", false},
+		{"/blog/post.gohtml", "Post", false},
+		{"/../blog/post.gohtml", "Post", false},
+		{"/broken.gohtml", nil, true},
+		{"/missing.gohtml", nil, false},
+	}
+
+	for _, elem := range tests {
+		dat := broker.Data(elem.path)
+		if dat["title"] != elem.title {
+			t.Errorf("file data %q: got title %v, expected %v", elem.path, dat["title"], elem.title)
+		}
+		if _, ok := dat["error"]; ok != elem.err {
+			t.Errorf("file data %q: got error %v, expected error %t", elem.path, dat["error"], elem.err)
+		}
+	}
+
+	// Cached until flushed
+	if err := os.WriteFile(filepath.Join(root, "index.gohtml.data"), []byte(`{"title": "Changed"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if dat := broker.Data("/index.gohtml"); dat["title"] != "Home" {
+		t.Errorf("file data cached: got title %v, expected %q", dat["title"], "Home")
+	}
+	broker.Flush()
+	if dat := broker.Data("/index.gohtml"); dat["title"] != "Changed" {
+		t.Errorf("file data flushed: got title %v, expected %q", dat["title"], "Changed")
+	}
+
+	// Missing files are looked for again
+	if err := os.WriteFile(filepath.Join(root, "missing.gohtml.data"), []byte(`{"title": "Found"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if dat := broker.Data("/missing.gohtml"); dat["title"] != "Found" {
+		t.Errorf("file data created: got title %v, expected %q", dat["title"], "Found")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Access log formats accepted by AccessLog.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// AccessLog wraps a handler, logging the method, path, status, size and
+// duration of each request to Out, or standard error if nil. Format is either
+// LogFormatText for human-readable lines, or LogFormatJSON for one JSON object
+// per line.
+type AccessLog struct {
+	Handler http.Handler
+	Format  string
+	Out     io.Writer
+}
+
+// accessEntry is a single request in the JSON access log format.
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying writer, if supported, so that streamed
+// responses are not held back by logging.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer, for use by http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (a AccessLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		a.log(start, r, sw)
+	}()
+
+	a.Handler.ServeHTTP(sw, r)
+}
+
+// log writes the entry for r, which began at start.
+func (a AccessLog) log(start time.Time, r *http.Request, sw *statusWriter) {
+	out := a.Out
+	if out == nil {
+		out = os.Stderr
+	}
+	d := time.Since(start)
+
+	if a.Format == LogFormatJSON {
+		json.NewEncoder(out).Encode(accessEntry{
+			Time:     start.UTC(),
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Status:   sw.status,
+			Bytes:    sw.bytes,
+			Duration: float64(d) / float64(time.Millisecond),
+		})
+		return
+	}
+
+	fmt.Fprintf(out, "%s %s %s %d %d %s\n",
+		start.Format("2006/01/02 15:04:05"), r.Method, r.URL.Path, sw.status, sw.bytes, d)
+}
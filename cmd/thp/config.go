@@ -0,0 +1,157 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ejv2/gtemplate"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration read from the file given by -config, in JSON
+// or, if its name ends in ".yaml" or ".yml", YAML. Relative paths are taken
+// relative to the directory of the file. Each setting is overridden by the
+// flag of the same name, if given.
+type Config struct {
+	Root    string `json:"root" yaml:"root"`
+	Include string `json:"include" yaml:"include"`
+	Data    string `json:"data" yaml:"data"`
+	Listen  string `json:"listen" yaml:"listen"`
+	Cert    string `json:"cert" yaml:"cert"`
+	Key     string `json:"key" yaml:"key"`
+
+	// Bindings maps broker patterns, such as "/about.gohtml" or "/blog/",
+	// to data merged over that of the data files for matching paths.
+	Bindings map[string]map[string]interface{} `json:"bindings" yaml:"bindings"`
+
+	bound *gtemplate.Broker // broker for Bindings, if any
+}
+
+// loadConfig reads and validates the config file at p. Unknown keys are
+// reported as errors.
+func loadConfig(p string) (*Config, error) {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(buf))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	for pattern := range cfg.Bindings {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("%s: binding %q: pattern must begin with a slash", p, pattern)
+		}
+	}
+	if len(cfg.Bindings) > 0 {
+		cfg.bound, err = cfg.broker()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+
+	dir := filepath.Dir(p)
+	for _, elem := range []*string{&cfg.Root, &cfg.Include, &cfg.Data, &cfg.Cert, &cfg.Key} {
+		if *elem != "" && !filepath.IsAbs(*elem) {
+			*elem = filepath.Join(dir, *elem)
+		}
+	}
+
+	return cfg, nil
+}
+
+// apply sets each flag of fs not given on the command line to the value in
+// the config, if any.
+func (cfg *Config) apply(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	settings := []struct {
+		name, value string
+	}{
+		{"root", cfg.Root},
+		{"include", cfg.Include},
+		{"data", cfg.Data},
+		{"listen", cfg.Listen},
+		{"cert", cfg.Cert},
+		{"key", cfg.Key},
+	}
+	for _, elem := range settings {
+		if elem.value == "" || given[elem.name] {
+			continue
+		}
+		if err := fs.Set(elem.name, elem.value); err != nil {
+			return fmt.Errorf("%s: %w", elem.name, err)
+		}
+	}
+
+	return nil
+}
+
+// broker returns a Broker for the bindings, or an error if any pattern is
+// rejected by the Broker.
+func (cfg *Config) broker() (b *gtemplate.Broker, err error) {
+	var pattern string
+	defer func() {
+		if v := recover(); v != nil {
+			b, err = nil, fmt.Errorf("binding %q: %v", pattern, v)
+		}
+	}()
+
+	b = gtemplate.NewBroker()
+	for pattern = range cfg.Bindings {
+		data := cfg.Bindings[pattern]
+		if data == nil {
+			data = make(map[string]interface{})
+		}
+		b.HandleData(pattern, data)
+	}
+
+	return b, nil
+}
+
+// BoundBroker merges the data bound to paths by the config file over the
+// data files of a Broker.
+type BoundBroker struct {
+	*Broker
+	Bound *gtemplate.Broker
+}
+
+func (b BoundBroker) Data(path string) map[string]interface{} {
+	bound := b.Bound.Data(path)
+	dat := b.Broker.Data(path)
+	if bound == nil {
+		return dat
+	}
+
+	merged := make(map[string]interface{}, len(dat)+len(bound))
+	for k, v := range dat {
+		merged[k] = v
+	}
+	for k, v := range bound {
+		merged[k] = v
+	}
+
+	return merged
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ejv2/gtemplate"
+)
+
+var dirListTemplate = template.Must(template.New("dirlist").Parse(`<!DOCTYPE html>
+
+<head>
+	<title>Index of {{.Path}}</title>
+</head>
+
+<body>
+	<h1>Index of {{.Path}}</h1>
+	<ul>
+	{{- range .Entries}}
+		<li><a href="{{.URL}}">{{.Name}}</a></li>
+	{{- end}}
+	</ul>
+</body>
+`))
+
+// DirList wraps a template handler, serving a generated listing of the
+// templates within any directory below Root which has no index template.
+type DirList struct {
+	Root    string
+	Handler http.Handler
+}
+
+func (d DirList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + r.URL.Path)
+	dir := filepath.Join(d.Root, filepath.FromSlash(p))
+
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		d.Handler.ServeHTTP(w, r)
+		return
+	}
+	if _, err := os.Stat(filepath.Join(dir, gtemplate.DirectoryIndex)); err == nil {
+		d.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	// Relative links require the directory form of the path
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(p)+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("dirlist: error reading %q: %s", dir, err.Error())
+		http.Error(w, "500 internal error", http.StatusInternalServerError)
+		return
+	}
+
+	type entry struct {
+		Name string
+		URL  string
+	}
+	list := struct {
+		Path    string
+		Entries []entry
+	}{Path: p}
+
+	for _, elem := range entries {
+		name := elem.Name()
+		if strings.HasPrefix(name, ".") || name == gtemplate.DirectoryIndex {
+			continue
+		}
+
+		if elem.IsDir() {
+			name += "/"
+		} else if path.Ext(name) != gtemplate.DefaultExtension {
+			continue
+		}
+
+		list.Entries = append(list.Entries, entry{
+			Name: name,
+			URL:  (&url.URL{Path: name}).String(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	dirListTemplate.Execute(w, list)
+}
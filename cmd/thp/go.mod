@@ -0,0 +1,10 @@
+module github.com/ejv2/gtemplate/cmd/thp
+
+go 1.18
+
+require (
+	github.com/ejv2/gtemplate v0.0.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+replace github.com/ejv2/gtemplate => ../..
@@ -0,0 +1,78 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// DefaultHealthPath is the default path of the health endpoint enabled by
+// -health.
+const DefaultHealthPath = "/_health"
+
+// Health reports the readiness of the server for load balancers and
+// orchestrators, without rendering any template. The server is ready while
+// each of Roots is an accessible directory.
+type Health struct {
+	Roots []string
+}
+
+// healthStatus is the body of a health response.
+type healthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// check returns an error if any root is inaccessible.
+func (h Health) check() error {
+	for _, elem := range h.Roots {
+		info, err := os.Stat(elem)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s: not a directory", elem)
+		}
+
+		f, err := os.Open(elem)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+
+	return nil
+}
+
+func (h Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, code := healthStatus{Status: "ok"}, http.StatusOK
+	if err := h.check(); err != nil {
+		status, code = healthStatus{Status: "unavailable", Error: err.Error()}, http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if r.Method != "HEAD" {
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// withHealth returns a mux serving the health endpoint at p in front of
+// hndl, which serves all other paths.
+func withHealth(hndl http.Handler, p string, h Health) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(p, h)
+	mux.Handle("/", hndl)
+
+	return mux
+}
@@ -6,28 +6,57 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ejv2/gtemplate"
+	"gopkg.in/yaml.v3"
 )
 
 var (
 	root    = flag.String("root", ".", "Document root for server")
 	include = flag.String("include", "", "Include root for server")
 	data    = flag.String("data", "", "Data root for server")
-	listen  = flag.String("listen", "", "Address on which to listen")
+	listen  = flag.String("listen", "", "Address on which to listen (default $GTEMPLATE_LISTEN, :$PORT, or :80/:443)")
 	cert    = flag.String("cert", "", "TLS certificate file")
 	key     = flag.String("key", "", "TLS key file")
+	dirlist = flag.Bool("dirlist", false, "List templates in directories without an index")
+	grace   = flag.Duration("grace", 10*time.Second, "Time allowed for in-flight requests on shutdown")
+	check   = flag.Bool("check", false, "Validate all templates against their data and exit")
+	lint    = flag.Bool("lint", false, "Check that all templates parse and exit")
+	logfmt  = flag.String("logformat", LogFormatText, "Access log format (text or json)")
+	config  = flag.String("config", "", "Config file (JSON or YAML) of settings overridden by flags")
+	health  = flag.Bool("health", false, "Serve a health-check endpoint reporting readiness")
+	hpath   = flag.String("healthpath", DefaultHealthPath, "Path of the health-check endpoint")
+	watch   = flag.Bool("watch", false, "Evict changed data files from the cache, polling them by stat, which works on any filesystem")
+	wpoll   = flag.Duration("watchinterval", time.Second, "Interval between checks of the data files under -watch")
 )
 
-// ReadAll is a less portable but more specific (and dependency-avoiding)
-// version of io.ReadAll.
+// dataFormats lists the supported data file formats in order of preference,
+// by the extension appended to "<path>.data" and the decoder for each.
+var dataFormats = []struct {
+	ext       string
+	unmarshal func([]byte, interface{}) error
+}{
+	{".yaml", yaml.Unmarshal},
+	{".yml", yaml.Unmarshal},
+	{"", json.Unmarshal},
+}
+
+// ReadAll is a less portable but more specific version of io.ReadAll, reading
+// an *os.File.
 func ReadAll(f *os.File) (buf []byte, err error) {
 	b := make([]byte, 0, 512)
 	for {
@@ -38,7 +67,7 @@ func ReadAll(f *os.File) (buf []byte, err error) {
 		n, err := f.Read(b[len(b):cap(b)])
 		b = b[:len(b)+n]
 		if err != nil {
-			if err.Error() == "EOF" {
+			if errors.Is(err, io.EOF) {
 				err = nil
 			}
 			return b, err
@@ -47,33 +76,52 @@ func ReadAll(f *os.File) (buf []byte, err error) {
 }
 
 type Broker struct {
-	// Protects cache
-	mut   sync.RWMutex
-	cache map[string]map[string]interface{}
+	// Protects cache and modTimes
+	mut      sync.RWMutex
+	cache    map[string]map[string]interface{}
+	modTimes map[string]time.Time // of each cached file when read
 }
 
 func (b *Broker) Data(path string) map[string]interface{} {
 	var state, remark = "failed", "unspecified reason"
 	defer func() { log.Printf("data: request for path %q %s: %s", path, state, remark) }()
 
-	dfile := path + ".data"
-	p := filepath.Join(*data, dfile)
+	base := filepath.Join(*data, path+".data")
 
 	// Check for cache hit - return early
 	b.mut.RLock()
-	if val, ok := b.cache[p]; ok {
-		defer b.mut.RUnlock()
+	for _, elem := range dataFormats {
+		if val, ok := b.cache[base+elem.ext]; ok {
+			b.mut.RUnlock()
 
-		state, remark = "success", "cache hit"
-		return val
+			state, remark = "success", "cache hit"
+			return val
+		}
 	}
 	b.mut.RUnlock()
 
-	f, err := os.Open(p)
-	if err != nil {
+	var f *os.File
+	var p string
+	var unmarshal func([]byte, interface{}) error
+	for _, elem := range dataFormats {
+		var err error
+		f, err = os.Open(base + elem.ext)
+		if err == nil {
+			p, unmarshal = base+elem.ext, elem.unmarshal
+			break
+		}
+	}
+	if f == nil {
 		state, remark = "failed", "no associated data"
 		return nil
 	}
+	defer f.Close()
+
+	// Taken before reading, so that no change is missed by Watch
+	var modTime time.Time
+	if info, err := f.Stat(); err == nil {
+		modTime = info.ModTime()
+	}
 
 	buf, err := ReadAll(f)
 	if err != nil {
@@ -82,7 +130,7 @@ func (b *Broker) Data(path string) map[string]interface{} {
 	}
 
 	res := make(map[string]interface{})
-	err = json.Unmarshal(buf, &res)
+	err = unmarshal(buf, &res)
 	if err != nil {
 		state, remark = "failed", "malformed data file: "+err.Error()
 		return nil
@@ -91,9 +139,11 @@ func (b *Broker) Data(path string) map[string]interface{} {
 	b.mut.Lock()
 	if b.cache == nil {
 		b.cache = make(map[string]map[string]interface{})
+		b.modTimes = make(map[string]time.Time)
 	}
 
 	b.cache[p] = res
+	b.modTimes[p] = modTime
 	b.mut.Unlock()
 
 	// Yay!
@@ -101,11 +151,146 @@ func (b *Broker) Data(path string) map[string]interface{} {
 	return res
 }
 
+// Flush discards all cached data, so that each data file is read afresh on
+// its next request.
+func (b *Broker) Flush() {
+	b.mut.Lock()
+	b.cache = nil
+	b.modTimes = nil
+	b.mut.Unlock()
+}
+
+// Watch checks the cached data files every interval until stop is closed,
+// evicting each which has changed or been removed since it was read, so that
+// edits are picked up by the next request while unchanged files stay cached.
+// Files are polled, as by the server's live reload, rather than watched
+// through filesystem notifications: a stat of each cached file works alike on
+// every platform and filesystem, including network and container mounts which
+// do not deliver notifications, and costs only as much as there are files
+// cached, whereas notifications would need a watch on each data directory.
+func (b *Broker) Watch(interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			b.evictChanged()
+		}
+	}
+}
+
+// evictChanged evicts each cached data file which has changed since read, or
+// which is now shadowed by a data file of a preferred format.
+func (b *Broker) evictChanged() {
+	b.mut.RLock()
+	modTimes := make(map[string]time.Time, len(b.modTimes))
+	for p, mt := range b.modTimes {
+		modTimes[p] = mt
+	}
+	b.mut.RUnlock()
+
+	for p, mt := range modTimes {
+		info, err := os.Stat(p)
+		if err == nil && info.ModTime().Equal(mt) && !shadowed(p) {
+			continue
+		}
+
+		b.mut.Lock()
+		// Unless re-read meanwhile
+		if cur, ok := b.modTimes[p]; ok && cur.Equal(mt) {
+			delete(b.cache, p)
+			delete(b.modTimes, p)
+			log.Printf("data: %s changed, evicting from cache", p)
+		}
+		b.mut.Unlock()
+	}
+}
+
+// shadowed reports whether a data file of a format preferred to that of the
+// data file p exists alongside it.
+func shadowed(p string) bool {
+	for i, elem := range dataFormats {
+		if !strings.HasSuffix(p, ".data"+elem.ext) {
+			continue
+		}
+
+		base := strings.TrimSuffix(p, elem.ext)
+		for _, pref := range dataFormats[:i] {
+			if _, err := os.Stat(base + pref.ext); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	return false
+}
+
+// listenAddr returns the address on which to listen. The -listen flag takes
+// precedence, followed by the GTEMPLATE_LISTEN environment variable, then the
+// port in the PORT environment variable, as set by many hosting platforms.
+// Otherwise, the default port for the protocol is used.
+func listenAddr(flagAddr string, tls bool) string {
+	if flagAddr != "" {
+		return flagAddr
+	}
+	if addr := os.Getenv("GTEMPLATE_LISTEN"); addr != "" {
+		return addr
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+
+	if tls {
+		return ":443"
+	}
+	return ":80"
+}
+
+// report logs each error found checking n templates, and returns the exit
+// status.
+func report(errs []error, n int) int {
+	for _, err := range errs {
+		log.Printf("check: %s", err.Error())
+	}
+	if len(errs) > 0 {
+		log.Printf("check: %d of %d templates failed", len(errs), n)
+		return 1
+	}
+
+	log.Printf("check: all %d templates ok", n)
+	return 0
+}
+
 func main() {
 	flag.Parse()
-	if (*cert == "" && *key != "") || (*cert != "" && *key == "") {
+
+	var cfg *Config
+	if *config != "" {
+		var err error
+		cfg, err = loadConfig(*config)
+		if err != nil {
+			log.Fatalf("config: %s", err.Error())
+		}
+		if err = cfg.apply(flag.CommandLine); err != nil {
+			log.Fatalf("config: %s", err.Error())
+		}
+	}
+	if !*check && !*lint && (*cert == "") != (*key == "") {
 		log.Fatalln("tls: must provide both certificate and key")
 	}
+	if *health && !strings.HasPrefix(*hpath, "/") {
+		log.Fatalf("invalid health path %q: must begin with a slash", *hpath)
+	}
+	if *logfmt != LogFormatText && *logfmt != LogFormatJSON {
+		log.Fatalf("invalid log format %q: must be %q or %q", *logfmt, LogFormatText, LogFormatJSON)
+	}
+	if *watch && *wpoll <= 0 {
+		log.Fatalf("invalid watch interval %s: must be positive", *wpoll)
+	}
 	if *data == "" {
 		*data = *root
 	}
@@ -114,33 +299,93 @@ func main() {
 	var err error
 	var hndl http.Handler
 	broker := new(Broker)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("data: received SIGHUP, flushing cache")
+			broker.Flush()
+		}
+	}()
+
+	var db gtemplate.DataBroker = broker
+	if cfg != nil && cfg.bound != nil {
+		db = BoundBroker{Broker: broker, Bound: cfg.bound}
+	}
+
+	var tsrv *gtemplate.TemplateServer
 	if *include != "" {
-		hndl, err = gtemplate.NewIncludesServer(*root, *include, broker)
+		tsrv, err = gtemplate.NewIncludesServer(*root, *include, db)
 	} else {
-		hndl, err = gtemplate.NewServer(*root, broker)
+		tsrv, err = gtemplate.NewServer(*root, db)
 	}
 
 	if err != nil {
 		log.Fatalf("template engine error: %s", err.Error())
 	}
+	if *check {
+		os.Exit(report(tsrv.Validate(), len(tsrv.Templates())))
+	}
+	if *lint {
+		os.Exit(report(tsrv.Warm(), len(tsrv.Templates())))
+	}
 
-	log.Println("server starting")
-	if *cert != "" {
-		if *listen == "" {
-			*listen = ":443"
+	hndl = tsrv
+	if *dirlist {
+		hndl = DirList{Root: *root, Handler: hndl}
+	}
+	hndl = AccessLog{Handler: hndl, Format: *logfmt}
+	if *health {
+		// Not logged, as polled frequently
+		roots := []string{*root, *data}
+		if *include != "" {
+			roots = append(roots, *include)
 		}
+		hndl = withHealth(hndl, *hpath, Health{Roots: roots})
+	}
 
-		err = http.ListenAndServeTLS(*listen, *cert, *key, hndl)
-	} else {
-		if *listen == "" {
-			*listen = ":80"
+	// Closed once the server has shut down
+	done := make(chan struct{})
+	if *watch {
+		if info, err := os.Stat(*data); err != nil || !info.IsDir() {
+			log.Printf("data: cannot watch %q, continuing without watching", *data)
+		} else {
+			go broker.Watch(*wpoll, done)
 		}
+	}
 
-		err = http.ListenAndServe(*listen, hndl)
+	srv := &http.Server{
+		Addr:    listenAddr(*listen, *cert != ""),
+		Handler: hndl,
+	}
+
+	// Allow in-flight requests to complete on interrupt
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer close(done)
+
+		sig := <-stop
+		log.Printf("received %s, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *grace)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown error: %s", err.Error())
+		}
+	}()
+
+	log.Println("server starting")
+	if *cert != "" {
+		err = srv.ListenAndServeTLS(*cert, *key)
+	} else {
+		err = srv.ListenAndServe()
 	}
 
 	if err != http.ErrServerClosed {
 		log.Fatalf("fatal server error: %s", err.Error())
 	}
+	<-done
 	log.Println("server terminating gracefully")
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadAll(t *testing.T) {
+	tests := [][]byte{
+		{},
+		[]byte(`{"title": "My Page"}`),
+		bytes.Repeat([]byte("gtemplate"), 1000),
+	}
+
+	for _, elem := range tests {
+		p := filepath.Join(t.TempDir(), "index.gohtml.data")
+		if err := os.WriteFile(p, elem, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ReadAll(f)
+		f.Close()
+
+		if err != nil {
+			t.Errorf("read %d bytes: got error %v, expected none", len(elem), err)
+		}
+		if !bytes.Equal(buf, elem) {
+			t.Errorf("read %d bytes: got %d bytes, expected contents unchanged", len(elem), len(buf))
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		flag, listenEnv, portEnv string
+		tls                      bool
+		expected                 string
+	}{
+		{"", "", "", false, ":80"},
+		{"", "", "", true, ":443"},
+		{"", "", "5000", true, ":5000"},
+		{"", "127.0.0.1:9000", "5000", false, "127.0.0.1:9000"},
+		{":8080", "127.0.0.1:9000", "5000", false, ":8080"},
+	}
+
+	for _, elem := range tests {
+		t.Setenv("GTEMPLATE_LISTEN", elem.listenEnv)
+		t.Setenv("PORT", elem.portEnv)
+
+		if got := listenAddr(elem.flag, elem.tls); got != elem.expected {
+			t.Errorf("listen %q (GTEMPLATE_LISTEN=%q, PORT=%q): got %q, expected %q",
+				elem.flag, elem.listenEnv, elem.portEnv, got, elem.expected)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	hndl := http.NewServeMux()
+	hndl.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	hndl.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+
+	var out bytes.Buffer
+	a := AccessLog{Handler: hndl, Format: LogFormatJSON, Out: &out}
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/missing", nil))
+
+	expected := []accessEntry{
+		{Method: "GET", Path: "/", Status: http.StatusOK, Bytes: 5},
+		{Method: "POST", Path: "/missing", Status: http.StatusNotFound, Bytes: 10},
+	}
+	dec := json.NewDecoder(&out)
+	for _, elem := range expected {
+		var got accessEntry
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("access log: got error %v decoding entry", err)
+		}
+		if got.Method != elem.Method || got.Path != elem.Path || got.Status != elem.Status || got.Bytes != elem.Bytes {
+			t.Errorf("access log %s %s: got %+v, expected %+v", elem.Method, elem.Path, got, elem)
+		}
+	}
+
+	out.Reset()
+	a.Format = LogFormatText
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+	if !strings.Contains(out.String(), " GET /missing 404 10 ") {
+		t.Errorf("access log text: got %q, expected method, path, status and size", out.String())
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, text string
+		ok         bool
+	}{
+		{"site.json", `{"root": "site", "listen": ":8080", "bindings": {"/about.gohtml": {"title": "About"}}}`, true},
+		{"site.yaml", "root: site\nlisten: \":8080\"\nbindings:\n  /about.gohtml:\n    title: About\n", true},
+		{"unknown.json", `{"root": "site", "roots": ["a", "b"]}`, false},
+		{"unknown.yml", "root: site\nroots: [a, b]\n", false},
+		{"relative.json", `{"bindings": {"about.gohtml": {}}}`, false},
+		{"index.json", `{"bindings": {"/index.gohtml": {}}}`, false},
+	}
+
+	for _, elem := range tests {
+		p := filepath.Join(dir, elem.name)
+		if err := os.WriteFile(p, []byte(elem.text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := loadConfig(p)
+		if (err == nil) != elem.ok {
+			t.Errorf("config %q: got error %v, expected success %v", elem.name, err, elem.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if cfg.Root != filepath.Join(dir, "site") || cfg.Listen != ":8080" {
+			t.Errorf("config %q: got root %q and listen %q, expected %q and \":8080\"", elem.name, cfg.Root, cfg.Listen, filepath.Join(dir, "site"))
+		}
+		if got := cfg.bound.Data("/about.gohtml")["title"]; got != "About" {
+			t.Errorf("config %q: got bound title %v, expected \"About\"", elem.name, got)
+		}
+
+		fs := flag.NewFlagSet("thp", flag.ContinueOnError)
+		root := fs.String("root", ".", "")
+		listen := fs.String("listen", "", "")
+		for _, name := range []string{"include", "data", "cert", "key"} {
+			fs.String(name, "", "")
+		}
+		if err := fs.Parse([]string{"-listen", ":9090"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.apply(fs); err != nil {
+			t.Errorf("config %q: got error %v applying, expected none", elem.name, err)
+		}
+		if *root != cfg.Root || *listen != ":9090" {
+			t.Errorf("config %q: got root %q and listen %q, expected %q and flag \":9090\"", elem.name, *root, *listen, cfg.Root)
+		}
+	}
+}
+
+func TestBoundBroker(t *testing.T) {
+	defer func(prev string) { *data = prev }(*data)
+	*data = t.TempDir()
+	if err := os.WriteFile(filepath.Join(*data, "about.gohtml.data"), []byte(`{"title": "File", "author": "Ethan"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{Bindings: map[string]map[string]interface{}{
+		"/about.gohtml": {"title": "About"},
+	}}
+	bound, err := cfg.broker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := BoundBroker{Broker: new(Broker), Bound: bound}
+	dat := b.Data("/about.gohtml")
+	if dat["title"] != "About" || dat["author"] != "Ethan" {
+		t.Errorf("bound broker: got %v, expected bound title over file data", dat)
+	}
+	if dat := b.Data("/other.gohtml"); dat != nil {
+		t.Errorf("bound broker: got %v for unbound path without data file, expected nil", dat)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	root := t.TempDir()
+	rendered := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rendered = true
+	})
+	hndl := withHealth(next, DefaultHealthPath, Health{Roots: []string{root}})
+
+	w := httptest.NewRecorder()
+	hndl.ServeHTTP(w, httptest.NewRequest("GET", DefaultHealthPath, nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"status":"ok"}` || rendered {
+		t.Errorf("health: got %d %q (rendered %v), expected 200 ok without rendering", w.Code, w.Body.String(), rendered)
+	}
+
+	hndl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/index.gohtml", nil))
+	if !rendered {
+		t.Errorf("health: other paths not passed to handler")
+	}
+
+	if err := os.Remove(root); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	hndl.ServeHTTP(w, httptest.NewRequest("GET", DefaultHealthPath, nil))
+
+	var status healthStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if w.Code != http.StatusServiceUnavailable || status.Status != "unavailable" || status.Error == "" {
+		t.Errorf("health missing root: got %d %q, expected 503 unavailable with error", w.Code, w.Body.String())
+	}
+}
+
+func TestBrokerWatch(t *testing.T) {
+	defer func(prev string) { *data = prev }(*data)
+	*data = t.TempDir()
+	for _, name := range []string{"a.gohtml.data", "b.gohtml.data"} {
+		if err := os.WriteFile(filepath.Join(*data, name), []byte(`{"title": "before"}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := new(Broker)
+	b.Data("/a.gohtml")
+	b.Data("/b.gohtml")
+
+	a := filepath.Join(*data, "a.gohtml.data")
+	if err := os.WriteFile(a, []byte(`{"title": "after"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(a, later, later); err != nil {
+		t.Fatal(err)
+	}
+	b.evictChanged()
+
+	if _, ok := b.cache[a]; ok {
+		t.Errorf("watch: changed file still cached")
+	}
+	if _, ok := b.cache[filepath.Join(*data, "b.gohtml.data")]; !ok {
+		t.Errorf("watch: unchanged file evicted")
+	}
+	if got := b.Data("/a.gohtml")["title"]; got != "after" {
+		t.Errorf("watch: got title %v after change, expected \"after\"", got)
+	}
+
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	b.evictChanged()
+	if dat := b.Data("/a.gohtml"); dat != nil {
+		t.Errorf("watch: got %v after removal, expected nil", dat)
+	}
+
+	// A new file of a preferred format replaces the cached one
+	if err := os.WriteFile(filepath.Join(*data, "b.gohtml.data.yaml"), []byte("title: yaml\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b.evictChanged()
+	if got := b.Data("/b.gohtml")["title"]; got != "yaml" {
+		t.Errorf("watch: got title %v after adding YAML, expected \"yaml\"", got)
+	}
+}
@@ -24,6 +24,22 @@ It can also be used in http.Handle for a path:
 	}
 	http.Handle("/content/", hndl)
 
+Templates can also be loaded from any fs.FS, such as an embedded filesystem,
+removing the need for the files to exist on disk at runtime:
+
+	//go:embed public
+	var site embed.FS
+
+	hndl, err := gtemplate.NewServerFS(site, "public", broker)
+
+Further configuration can be given to NewServerOpts as a list of options:
+
+	hndl, err := gtemplate.NewServerOpts("public/",
+		gtemplate.WithBroker(broker),
+		gtemplate.WithIncludes("templates/"),
+		gtemplate.WithFuncs(template.FuncMap{"upper": strings.ToUpper}),
+	)
+
 In these examples, "broker" is used as a substitute for a data broker,
 which is simply a type capable of supplying an arbitrary map of string
 keys to any type for usage in the template. In the test suite, an example
@@ -0,0 +1,153 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"errors"
+	"html/template"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Helper function errors.
+var (
+	ErrDictArgs = errors.New("gtemplate: dict: expected key and value pairs")
+	ErrDictKey  = errors.New("gtemplate: dict: keys must be strings")
+)
+
+// DefaultFuncs returns a new map of common helper functions, for use as a
+// server's Funcs, for example with WithFuncs(DefaultFuncs()). The map may be
+// extended with the caller's own functions. The helpers are:
+//
+//	formatTime LAYOUT TIME  TIME formatted by LAYOUT, or "" if TIME is zero
+//	upper STRING            STRING in upper case
+//	lower STRING            STRING in lower case
+//	title STRING            STRING with the first letter of each word in upper case
+//	truncate N STRING       STRING cut to at most N characters
+//	default FALLBACK VALUE  VALUE, or FALLBACK if VALUE is empty
+//	dict KEY VALUE...       a map of each KEY to the following VALUE
+//	urljoin BASE ELEM...    BASE URL with each ELEM joined to its path
+//
+// The arguments are ordered such that the value being operated on may be
+// piped in, as in {{.author | default "anonymous" | upper}}. A value is empty
+// if it is nil or the zero value of its type, or an empty slice or map.
+func DefaultFuncs() template.FuncMap {
+	return template.FuncMap{
+		"formatTime": formatTime,
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      title,
+		"truncate":   truncate,
+		"default":    defaultValue,
+		"dict":       dict,
+		"urljoin":    urljoin,
+	}
+}
+
+func formatTime(layout string, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(layout)
+}
+
+func title(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+
+	start := true
+	for _, r := range s {
+		if start {
+			r = unicode.ToTitle(r)
+		}
+		start = unicode.IsSpace(r)
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func truncate(n int, s string) string {
+	if n <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	i := 0
+	for j := range s {
+		if i == n {
+			return s[:j]
+		}
+		i++
+	}
+	return s
+}
+
+func defaultValue(fallback, v interface{}) interface{} {
+	if v == nil {
+		return fallback
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map:
+		if rv.Len() == 0 {
+			return fallback
+		}
+	default:
+		if rv.IsZero() {
+			return fallback
+		}
+	}
+
+	return v
+}
+
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, ErrDictArgs
+	}
+
+	m := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		k, ok := pairs[i].(string)
+		if !ok {
+			return nil, ErrDictKey
+		}
+		m[k] = pairs[i+1]
+	}
+
+	return m, nil
+}
+
+func urljoin(base string, elems ...string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if len(elems) == 0 {
+		return u.String(), nil
+	}
+
+	p := u.Path
+	if u.Host != "" && !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	trailing := strings.HasSuffix(elems[len(elems)-1], "/")
+	u.Path = path.Join(append([]string{p}, elems...)...)
+	if trailing && u.Path != "/" {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+
+	return u.String(), nil
+}
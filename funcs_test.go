@@ -0,0 +1,147 @@
+package gtemplate
+
+import (
+	"bytes"
+	"html/template"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFormatTime(t *testing.T) {
+	tests := []struct {
+		layout   string
+		t        time.Time
+		expected string
+	}{
+		{"2006-01-02", time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC), "2022-03-04"},
+		{time.Kitchen, time.Date(2022, 3, 4, 17, 6, 7, 0, time.UTC), "5:06PM"},
+		{"2006-01-02", time.Time{}, ""},
+		{"", time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC), ""},
+	}
+
+	for _, elem := range tests {
+		if got := formatTime(elem.layout, elem.t); got != elem.expected {
+			t.Errorf("formatTime %q %v: got %q, expected %q", elem.layout, elem.t, got, elem.expected)
+		}
+	}
+}
+
+func TestTitle(t *testing.T) {
+	tests := []struct {
+		s, expected string
+	}{
+		{"", ""},
+		{"hello world", "Hello World"},
+		{"  spaced\tout\nwords", "  Spaced\tOut\nWords"},
+		{"élan vital", "Élan Vital"},
+		{"ALREADY Upper", "ALREADY Upper"},
+	}
+
+	for _, elem := range tests {
+		if got := title(elem.s); got != elem.expected {
+			t.Errorf("title %q: got %q, expected %q", elem.s, got, elem.expected)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		n           int
+		s, expected string
+	}{
+		{5, "", ""},
+		{5, "hello world", "hello"},
+		{20, "hello world", "hello world"},
+		{11, "hello world", "hello world"},
+		{0, "hello", ""},
+		{-1, "hello", ""},
+		{2, "héllo", "hé"},
+		{1, "日本語", "日"},
+	}
+
+	for _, elem := range tests {
+		if got := truncate(elem.n, elem.s); got != elem.expected {
+			t.Errorf("truncate %d %q: got %q, expected %q", elem.n, elem.s, got, elem.expected)
+		}
+	}
+}
+
+func TestDefaultValue(t *testing.T) {
+	tests := []struct {
+		v, expected interface{}
+	}{
+		{nil, "fallback"},
+		{"", "fallback"},
+		{0, "fallback"},
+		{false, "fallback"},
+		{time.Time{}, "fallback"},
+		{[]string{}, "fallback"},
+		{map[string]int{}, "fallback"},
+		{"value", "value"},
+		{42, 42},
+		{[]string{"a"}, []string{"a"}},
+	}
+
+	for _, elem := range tests {
+		if got := defaultValue("fallback", elem.v); !reflect.DeepEqual(got, elem.expected) {
+			t.Errorf("default %#v: got %#v, expected %#v", elem.v, got, elem.expected)
+		}
+	}
+}
+
+func TestDict(t *testing.T) {
+	m, err := dict("title", "My Page", "count", 3)
+	if err != nil || !reflect.DeepEqual(m, map[string]interface{}{"title": "My Page", "count": 3}) {
+		t.Errorf("dict: got %v (error %v), expected two entries", m, err)
+	}
+	if m, err := dict(); err != nil || len(m) != 0 {
+		t.Errorf("dict: got %v (error %v) for no arguments, expected empty map", m, err)
+	}
+	if _, err := dict("title"); err != ErrDictArgs {
+		t.Errorf("dict: got error %v for odd arguments, expected %v", err, ErrDictArgs)
+	}
+	if _, err := dict(1, "one"); err != ErrDictKey {
+		t.Errorf("dict: got error %v for integer key, expected %v", err, ErrDictKey)
+	}
+}
+
+func TestURLJoin(t *testing.T) {
+	tests := []struct {
+		base     string
+		elems    []string
+		expected string
+	}{
+		{"https://example.com", []string{"blog", "post"}, "https://example.com/blog/post"},
+		{"https://example.com/", []string{"/blog/", "/post/"}, "https://example.com/blog/post/"},
+		{"https://example.com/a?q=1", []string{"b"}, "https://example.com/a/b?q=1"},
+		{"https://example.com/a", nil, "https://example.com/a"},
+		{"https://example.com/a", []string{""}, "https://example.com/a"},
+		{"/static", []string{"css", "main.css"}, "/static/css/main.css"},
+		{"", []string{"a", "b"}, "a/b"},
+		{"https://example.com", []string{"a b"}, "https://example.com/a%20b"},
+	}
+
+	for _, elem := range tests {
+		got, err := urljoin(elem.base, elem.elems...)
+		if err != nil || got != elem.expected {
+			t.Errorf("urljoin %q %q: got %q (error %v), expected %q", elem.base, elem.elems, got, err, elem.expected)
+		}
+	}
+
+	if _, err := urljoin("http://[::1", "a"); err == nil {
+		t.Errorf("urljoin: got no error for malformed base")
+	}
+}
+
+func TestDefaultFuncs(t *testing.T) {
+	tmpl := template.Must(template.New("").Funcs(DefaultFuncs()).Parse(
+		`{{.author | default "anonymous" | title}} {{truncate 4 .title | upper}}` +
+			`{{with dict "a" 1}} {{.a}}{{end}} {{urljoin "/blog" "post"}}`))
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, map[string]interface{}{"author": "", "title": "gtemplate"})
+	if expected := "Anonymous GTEM 1 /blog/post"; err != nil || buf.String() != expected {
+		t.Errorf("default funcs: got %q (error %v), expected %q", buf.String(), err, expected)
+	}
+}
@@ -3,13 +3,29 @@
 package gtemplate
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
+	"time"
 )
 
 // TemplateServer returned errors.
@@ -17,8 +33,36 @@ var (
 	ErrRootInvalid     = errors.New("gtemplate: root: invalid root directory")
 	ErrIncludesInvalid = errors.New("gtemplate: includes: invalid includes directory")
 	ErrAlreadyParsed   = errors.New("gtemplate: attempted to re-parse for path")
+	ErrIncludesDepth   = errors.New("gtemplate: includes: maximum directory depth exceeded")
+	ErrIncludesLoop    = errors.New("gtemplate: includes: symbolic link loop detected")
+	ErrMissingKey      = errors.New("gtemplate: invalid missingkey option")
+	ErrIncludesPattern = errors.New("gtemplate: includes: malformed include pattern")
+	ErrIncludesClash   = errors.New("gtemplate: includes: duplicate include name")
+	ErrNoData          = errors.New("gtemplate: broker returned no data")
+	ErrBrokerData      = errors.New("gtemplate: broker reported an error")
 )
 
+// DefaultContentTypes maps template file extensions to the Content-Type sent
+// with their output, unless overridden by a server's ContentTypes.
+var DefaultContentTypes = map[string]string{
+	".gohtml": "text/html; charset=utf-8",
+	".html":   "text/html; charset=utf-8",
+	".htm":    "text/html; charset=utf-8",
+	".xml":    "application/xml; charset=utf-8",
+	".rss":    "application/rss+xml; charset=utf-8",
+	".atom":   "application/atom+xml; charset=utf-8",
+	".svg":    "image/svg+xml; charset=utf-8",
+	".json":   "application/json; charset=utf-8",
+	".txt":    "text/plain; charset=utf-8",
+	".css":    "text/css; charset=utf-8",
+	".js":     "text/javascript; charset=utf-8",
+}
+
+// DefaultMaxIncludeDepth is the maximum number of directories deep searched
+// for include templates below the include root if a server's
+// MaxIncludeDepth is zero.
+const DefaultMaxIncludeDepth = 32
+
 // A DataBroker is responsible for mapping data to bind to a
 // specific path, passed as an argument to Data.
 // This allows different or the same data to be provided based
@@ -27,6 +71,206 @@ type DataBroker interface {
 	Data(path string) map[string]interface{}
 }
 
+// A ContextDataBroker is a DataBroker which accepts a context which is
+// cancelled if the client goes away before its data has been fetched,
+// allowing long running lookups to be abandoned. If a server's broker
+// implements ContextDataBroker, DataCtx is called in preference to Data with
+// the request's context.
+type ContextDataBroker interface {
+	DataBroker
+	DataCtx(ctx context.Context, path string) map[string]interface{}
+}
+
+// A RequestDataBroker is a DataBroker which can also make use of the request
+// being served, such as its query string, cookies or headers. If a server's
+// broker implements RequestDataBroker, DataForRequest is always called in
+// preference to both Data and DataCtx.
+//
+// The request passed to DataForRequest is a shallow copy of the original, in
+// which URL.Path has been replaced by the path of the template being served.
+type RequestDataBroker interface {
+	DataBroker
+	DataForRequest(r *http.Request) map[string]interface{}
+}
+
+// A ContentLayout renders content files, such as Markdown, as HTML within a
+// layout template. See TemplateServer.ContentLayouts.
+type ContentLayout struct {
+	// Layout is the path within the document root of the template which
+	// renders each content file.
+	Layout string
+
+	// Convert converts the source of a content file to HTML, such as
+	// using a Markdown library. The output is trusted, and so must be
+	// sanitised by Convert if the source is not.
+	Convert func(src []byte) (template.HTML, error)
+}
+
+// An Observer is notified of the work done by a TemplateServer, such as to
+// record metrics or trace slow templates. Methods may be called concurrently.
+type Observer interface {
+	// OnLoad is called after the template file at path has been loaded
+	// and parsed, or failed to, taking dur. Templates served from the
+	// cache are not loaded.
+	OnLoad(path string, dur time.Duration, err error)
+
+	// OnRender is called after the template at path has been executed,
+	// taking dur, with any error executing it.
+	OnRender(path string, dur time.Duration, err error)
+}
+
+// An AnyDataBroker is a DataBroker which supplies a value of any type, such
+// as a struct, as the root data of each template, in place of a data map. If
+// a server's broker implements AnyDataBroker, AnyData is always called in
+// preference to Data, DataCtx and DataForRequest, which are never called.
+// As there is no data map, neither the reserved keys nor QueryData apply.
+type AnyDataBroker interface {
+	DataBroker
+	AnyData(path string) interface{}
+}
+
+// A FuncDataBroker is a DataBroker which also supplies functions to the
+// template at each path, such as closures which look up related records.
+// If a server's broker implements FuncDataBroker, Funcs is called with the
+// path of each template when it is parsed, making the functions available
+// to it alongside those of the server, and again each time it is executed,
+// the functions then returned replacing those with which it was parsed.
+//
+// As html/template binds functions to a template set when parsed, Funcs
+// must return functions of the same names for a path on every call. Where
+// it returns any, the template is executed by way of a clone of the cached
+// set; clones are kept for reuse by later executions, so that each is
+// cloned and escaped only once, but as many are held as there have been
+// concurrent executions. The functions are not available under SharedRoot.
+type FuncDataBroker interface {
+	DataBroker
+	Funcs(path string) template.FuncMap
+}
+
+// contextData returns the data for path from broker, passing ctx through if
+// the broker is a ContextDataBroker.
+func contextData(ctx context.Context, broker DataBroker, path string) map[string]interface{} {
+	if cb, ok := broker.(ContextDataBroker); ok {
+		return cb.DataCtx(ctx, path)
+	}
+
+	return broker.Data(path)
+}
+
+// renderer is the subset of the html/template and text/template APIs used to
+// execute a cached template.
+type renderer interface {
+	ExecuteTemplate(w io.Writer, name string, data interface{}) error
+}
+
+// cachedTemplate is a parsed template set held in the template cache.
+type cachedTemplate struct {
+	used uint64 // recency of use under MaxCached, updated atomically; first for alignment
+	renderer
+	name    string       // name of the template executed to render the set
+	modTime time.Time    // modification time of the template file
+	layer   int          // document root from which the template was loaded
+	shared  *includeBase // base holding the set, under SharedRoot
+	sets    *funcSets    // clones for the functions of a FuncDataBroker, if any
+}
+
+// Execute renders the template set to w.
+func (t *cachedTemplate) Execute(w io.Writer, data interface{}) error {
+	return t.ExecuteTemplate(w, t.name, data)
+}
+
+// executeFuncs renders the template set to w with funcs replacing the
+// functions of the same names. Unless funcs is empty, the set is executed
+// by way of a clone reserved for the execution.
+func (t *cachedTemplate) executeFuncs(w io.Writer, funcs template.FuncMap, data interface{}) error {
+	if t.sets == nil || len(funcs) == 0 {
+		return t.Execute(w, data)
+	}
+
+	pool := t.sets.pool(funcs)
+	c, _ := pool.Get().(renderer)
+	if c == nil {
+		var err error
+		c, err = cloneSet(t.sets.proto)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch set := c.(type) {
+	case *template.Template:
+		set.Funcs(funcs)
+	case *texttemplate.Template:
+		set.Funcs(texttemplate.FuncMap(funcs))
+	}
+	err := c.ExecuteTemplate(w, t.name, data)
+	pool.Put(c)
+
+	return err
+}
+
+// funcSets holds clones of a template set for execution with the functions
+// of a FuncDataBroker, pooled by the names of the functions. Each clone is
+// escaped on its first execution and reused by later executions, one at a
+// time, so that the set need not be cloned and escaped afresh for each.
+type funcSets struct {
+	proto renderer // unexecuted clone of the set, from which others are cloned
+
+	mut   sync.Mutex
+	pools map[string]*sync.Pool
+}
+
+// newFuncSets returns the funcSets for the template set r, which must not yet
+// have been executed.
+func newFuncSets(r renderer) (*funcSets, error) {
+	proto, err := cloneSet(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &funcSets{proto: proto, pools: make(map[string]*sync.Pool)}, nil
+}
+
+// pool returns the pool of clones for the names of funcs.
+func (s *funcSets) pool(funcs template.FuncMap) *sync.Pool {
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := strings.Join(names, "\x00")
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	p, ok := s.pools[key]
+	if !ok {
+		p = new(sync.Pool)
+		s.pools[key] = p
+	}
+
+	return p
+}
+
+// cloneSet returns a clone of the template set r.
+func cloneSet(r renderer) (renderer, error) {
+	switch set := r.(type) {
+	case *template.Template:
+		c, err := set.Clone()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case *texttemplate.Template:
+		c, err := set.Clone()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	return r, nil
+}
+
 // A TemplateServer is analogous to a Go standard file server, but
 // which passes files through the template engine first, intended
 // for simple dynamic sites. It acts as the http.Handler for a
@@ -34,11 +278,384 @@ type DataBroker interface {
 // routed using templating logic. Templates are loaded from disk upon
 // first request and the compilation result cached in a map of paths.
 type TemplateServer struct {
-	broker    DataBroker
-	mut       sync.RWMutex
-	templates map[string]*template.Template
-	includes  []string
-	root      string
+	stats serverCounters // first for 64-bit alignment of atomic counters
+
+	// NotFoundTemplate is the path, relative to the document root, of a
+	// template to execute when a requested template cannot be loaded. It
+	// is executed with status 404 and the broker's data for the requested
+	// path. If empty, or if it too cannot be loaded or executed, a plain
+	// text 404 is sent instead.
+	NotFoundTemplate string
+
+	// ErrorTemplate is the path, relative to the document root, of a
+	// template to execute in place of the requested one when the broker
+	// reports an error by returning data containing ErrorKey, as a failing
+	// BrokerFunc, JSONBroker or FileDataBroker does. It is executed with
+	// status 500 and the broker's data, such that the message is available
+	// as {{.error}}. If it too cannot be loaded or executed, the error,
+	// satisfying errors.Is(err, ErrBrokerData), is handled by ErrorHandler
+	// if set. If empty, ErrorKey is not reserved, and is given to the
+	// requested template as any other key.
+	ErrorTemplate string
+
+	// TextPaths lists request paths, such as "/robots.txt" or
+	// "/.well-known/security.txt", which are rendered using text/template
+	// rather than html/template. Their output is not HTML escaped and is
+	// served as text/plain unless overridden by ContentTypes.
+	TextPaths []string
+
+	// TextMode renders every template using text/template rather than
+	// html/template, for servers generating plain text such as emails or
+	// CSV. As with TextPaths, output is served as text/plain unless
+	// overridden by ContentTypes. Text templates perform no contextual
+	// escaping whatsoever: data is written exactly as given, so any
+	// output which may be interpreted as HTML by a browser must not
+	// include untrusted data.
+	TextMode bool
+
+	// ContentTypes maps template file extensions, including the leading
+	// dot, to the Content-Type sent with their output. Entries override
+	// those in DefaultContentTypes. Output of templates whose extension is
+	// found in neither is typed by the mime package, or failing that by
+	// content sniffing.
+	ContentTypes map[string]string
+
+	// SecurityHeaders are response headers, such as a
+	// Content-Security-Policy, sent with every response, including errors
+	// and not found responses. Headers set by a template's data using
+	// HeadersKey take precedence. DefaultSecurityHeaders returns a
+	// suitable starting point.
+	SecurityHeaders map[string]string
+
+	// NoncePolicy, if set, is a Content-Security-Policy sent with each
+	// rendered template, in which each occurrence of NoncePlaceholder is
+	// replaced by a nonce freshly generated for the request from
+	// crypto/rand, for example "script-src 'nonce-{nonce}'". The same nonce
+	// is given to the template under NonceKey, for use as the nonce
+	// attribute of inline scripts and styles. It replaces any policy set
+	// by SecurityHeaders. The nonce is unavailable to an AnyDataBroker.
+	NoncePolicy string
+
+	// RequestID gives each request an ID, taken from its RequestIDHeader if
+	// the client or a proxy sent a valid one, or else freshly generated
+	// from crypto/rand. The ID is echoed in the response's RequestIDHeader,
+	// stored in the request's context, from which middleware and a
+	// ContextDataBroker may read it with RequestIDFromContext, and given to
+	// the template under RequestIDKey.
+	RequestID bool
+
+	// ContentLayouts maps the file extensions of content files, including
+	// the leading dot, such as ".md", to the layout rendering them. A
+	// request for a content file is served by executing its layout, with
+	// the data for the content file's path and the converted content under
+	// ContentKey. Content files are read and converted on every request.
+	ContentLayouts map[string]ContentLayout
+
+	// Variants enables content negotiation, serving a variant of the
+	// requested template, such as JSON for an API client, when the
+	// request's Accept header prefers its media type to that of the
+	// template itself. Variants are tried in order when equally
+	// preferred. If the template has no acceptable variant, the template
+	// itself is served. The data is that for the requested template.
+	Variants []Variant
+
+	// ErrorHandler, if non-nil, is called when a template fails to
+	// execute, or when a panic, such as in the broker, is recovered while
+	// serving a request. If nil, the error is sent to the client as plain text with
+	// status 500. Unless Unbuffered is set, nothing has yet been written to
+	// the ResponseWriter when ErrorHandler is called.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+	// Unbuffered causes templates to be executed directly to the client.
+	// By default, output is rendered into memory first and sent only if
+	// execution succeeds, so that a failure never leaves a partially
+	// written page. Unbuffered trades this guarantee for lower memory use
+	// on very large pages.
+	Unbuffered bool
+
+	// FlushInterval, if non-zero, streams Unbuffered output, flushing it
+	// to the client during rendering at most once per interval, so that
+	// the start of a long page, or each event of a template serving
+	// Server-Sent Events, is received without waiting for the whole
+	// render. A negative interval flushes after every write. As output
+	// may reach the client before an error occurs, an error part way
+	// through rendering leaves a truncated response which cannot be
+	// replaced by an error page. FlushInterval has no effect unless
+	// Unbuffered is set and the ResponseWriter is an http.Flusher.
+	FlushInterval time.Duration
+
+	// RenderTimeout, if positive, limits the time taken to serve each
+	// request, including fetching its data and rendering its template.
+	// Once the timeout expires, the request's context is cancelled, so
+	// that a ContextDataBroker or RequestDataBroker may abandon its work,
+	// and the client is sent 503 Service Unavailable. As template
+	// execution cannot be interrupted, a render still in progress runs to
+	// completion in the background, but its output is discarded. While a
+	// timeout is set, responses are buffered in full, and so FlushInterval
+	// has no effect. The live reload endpoint is not subject to the
+	// timeout.
+	RenderTimeout time.Duration
+
+	// FollowSymlinks allows symbolic links to be followed to anywhere on
+	// the filesystem when loading templates and includes. By default, a
+	// symbolic link is only followed if it resolves to a location inside
+	// the root in which it was found; templates reached through links
+	// leading outside the document root are refused and such includes are
+	// skipped.
+	FollowSymlinks bool
+
+	// Compression enables gzip compression of output sent to clients
+	// which accept it. Buffered output smaller than CompressionMinSize
+	// bytes is always sent uncompressed, as compressing small responses
+	// is rarely worthwhile.
+	Compression        bool
+	CompressionMinSize int
+
+	// StaticExtensions lists file extensions, including the leading dot,
+	// such as ".css" or ".png", of files served as they are rather than
+	// executed as templates. They are sent using http.ServeContent, and so
+	// support conditional and range requests, with the Cache-Control set
+	// by SetCacheControl for their paths.
+	StaticExtensions []string
+
+	// PrecompressedStatic serves a static file's sibling with ".gz"
+	// appended, such as "style.css.gz" for "style.css", in its place to
+	// clients which accept gzip, with Content-Encoding: gzip, avoiding the
+	// cost of compressing it on each request. The compressed file is only
+	// used if it is at least as new as the original, and the original is
+	// served otherwise.
+	PrecompressedStatic bool
+
+	// CaseInsensitive matches requested paths to templates regardless of
+	// case, such that "/About/Team.gohtml" serves "about/team.gohtml".
+	// Each element of the path which does not exist as requested is
+	// matched to a file in its directory, and the broker is given the path
+	// as found on disk. Where several files in a directory differ only by
+	// case, such as "Page.gohtml" and "page.gohtml", a request naming
+	// either exactly is served that file, and any other spelling is served
+	// whichever sorts first by byte value, in this case "Page.gohtml".
+	// On a filesystem which is itself case insensitive, every spelling
+	// exists, and so is passed on to the broker as requested. Matching
+	// costs a directory listing per mismatched element, and applies only
+	// to ServeHTTP.
+	CaseInsensitive bool
+
+	// TrailingSlashRedirect, if non-zero, is the status, such as 301 Moved
+	// Permanently or 308 Permanent Redirect, with which requests for a
+	// missing template are redirected to the same path with its trailing
+	// slash removed or added, if that names a template. For example,
+	// "/about/" is redirected to "/about" if only "about.gohtml" exists,
+	// and "/blog" to "/blog/" if the directory has an index. If zero, such
+	// requests are not found.
+	TrailingSlashRedirect int
+
+	// MaxCached, if positive, limits the number of templates held in the
+	// cache, such as for sites with very many pages. Once the limit is
+	// exceeded, the least recently used templates are evicted, to be
+	// parsed again when next requested. Each eviction takes time
+	// proportional to MaxCached. If zero, the cache is unbounded.
+	MaxCached int
+
+	// ETag causes an entity tag, computed by hashing the rendered output,
+	// to be sent with each response. GET and HEAD requests carrying a
+	// matching If-None-Match header are answered with 304 Not Modified.
+	// As the whole output is needed to compute the tag, ETag has no effect
+	// if Unbuffered is set.
+	ETag bool
+
+	// LastModified causes a Last-Modified header to be sent with each
+	// successful response, being the later of the modification time of
+	// the template's file, or content file under ContentLayouts, and that
+	// given by the broker under ModTimeKey. GET and HEAD requests carrying
+	// an If-Modified-Since header no earlier are answered with 304 Not
+	// Modified without rendering the template. As includes, layouts and
+	// data without ModTimeKey are not considered, it should only be set
+	// where the modification times reflect the content of each page.
+	LastModified bool
+
+	// AnyMethod allows templates to be rendered in response to requests of
+	// any method, such as a POST to a page whose broker reads the submitted
+	// form. By default, only GET, HEAD and OPTIONS are allowed, and other
+	// methods are answered with 405 Method Not Allowed.
+	AnyMethod bool
+
+	// QueryData adds the request's query parameters to the data of each
+	// template under QueryKey, as a map of each parameter's first value,
+	// such that "?page=2" is available as {{.query.page}}. Data from the
+	// broker under the same key takes precedence.
+	QueryData bool
+
+	// StrictData treats a template for which the broker returns nil data
+	// as an error, satisfying errors.Is(err, ErrNoData), rather than
+	// rendering it with no data, so that broken data wiring is caught
+	// early. The error is handled as any other, by ErrorHandler if set,
+	// which may send a status other than 500. An empty map is not an
+	// error. StrictData has no effect with an AnyDataBroker.
+	StrictData bool
+
+	// DefaultData is merged beneath the data the broker returns for every
+	// template, such that keys from the broker take precedence, providing
+	// fields such as the site name to all templates without repeating
+	// them in each broker. Reserved keys, such as HeadersKey, apply as if
+	// returned by the broker. Templates for which the broker returns nil
+	// are rendered with DefaultData, or an empty map if it too is nil,
+	// rather than with nil data, except under StrictData. DefaultData has
+	// no effect with an AnyDataBroker, and must not be modified once the
+	// server is in use.
+	DefaultData map[string]interface{}
+
+	// CookieData adds the request's cookies to the data of each template
+	// under CookiesKey, as a map of each cookie's name to its value, such
+	// that a cookie "theme" is available as {{.cookies.theme}}. Data from
+	// the broker under the same key takes precedence. If CookieFilter is
+	// set, only the cookies for whose names it returns true are added,
+	// such as to keep session tokens out of templates.
+	CookieData   bool
+	CookieFilter func(name string) bool
+
+	// IncludePattern, if set, restricts the files in the include root
+	// loaded as includes to those whose names match it, as understood by
+	// path.Match. For example, "*.gohtml" skips notes or other files which
+	// are not templates. Directories are always searched. As includes are
+	// read when the server is created, it should be set through
+	// WithIncludePattern, or else takes effect on the next Reload.
+	IncludePattern string
+
+	// MaxIncludeDepth is the maximum number of directories deep which will
+	// be searched for include templates below the include root, beyond
+	// which ErrIncludesDepth is returned. If zero, it is
+	// DefaultMaxIncludeDepth. As includes are read when the server is
+	// created, it should be set through WithMaxIncludeDepth, or else takes
+	// effect on the next Reload.
+	MaxIncludeDepth int
+
+	// NamespaceIncludes names each include template by its path relative
+	// to the include root, such as "partials/header.gohtml", rather than
+	// by its file name alone. This allows includes in different
+	// directories to share a file name. Otherwise, such includes are
+	// reported as an ErrIncludesClash when the server is created. It
+	// should be set through WithNamespacedIncludes.
+	NamespaceIncludes bool
+
+	// Layout is the path, relative to the document root, of a base
+	// template shared by other pages. The layout declares replaceable
+	// sections using {{block "name" .}} actions. A page which defines any
+	// template also defined by the layout, such as with {{define "name"}},
+	// is parsed together with the layout and rendered by executing the
+	// layout, with the page's definitions filling its blocks. Pages which
+	// define none of the layout's templates are rendered standalone.
+	Layout string
+
+	// SharedRoot parses every HTML template in the document root into a
+	// single set, along with the includes, such that any template may
+	// execute any other with {{template "name"}}, whether by a name it
+	// defines or by its path relative to the root, as in
+	// {{template "blog/post.gohtml" .}}. Otherwise, each template is
+	// parsed into a set of its own, and only includes are shared.
+	//
+	// The set is parsed in full when the first template is requested, and
+	// is held only once, rather than once per template, but every template
+	// in the root is parsed whether or not it is ever served, and a syntax
+	// error in any one template fails every request. Names are shared
+	// across the whole root, so that where several templates define the
+	// same name, the definition in the last by path order is used by all.
+	// For the same reason, Layout is not applied to templates in the set,
+	// and per-path functions registered with FuncsFor are unavailable;
+	// such functions must be set in Funcs. Templates rendered as text,
+	// being those under TextMode, TextPaths or a Text Variant, are
+	// parsed individually as before. In DevMode, any change within the
+	// root causes the set to be parsed afresh. It should be set through
+	// WithSharedRoot.
+	SharedRoot bool
+
+	// Extension is the file extension of templates, including the leading
+	// dot. Defaults to DefaultExtension. A Broker given to NewServerOpts
+	// takes the Extension and Index of the server; if either is set
+	// otherwise, the Broker's must be set to match.
+	Extension string
+
+	// Index is the file name of the template served for requests for a
+	// directory, including the root of the server. If empty, it is
+	// "index" + Extension. See Extension for its use by a Broker.
+	Index string
+
+	// RootTemplate is the path, relative to the document root, of the
+	// template served for the root of the server, "/", in place of the
+	// Index, such as "home.gohtml". Requests for any other directory still
+	// resolve to its Index. The template is given the broker's data for
+	// its own path, such as "/home.gohtml", at which it also remains
+	// available. If empty, the root is served by its Index.
+	RootTemplate string
+
+	// Funcs is added to the function map of each template before it is
+	// parsed, making the functions available to all templates, including
+	// includes and layouts.
+	Funcs template.FuncMap
+
+	// LeftDelim and RightDelim are the action delimiters used when parsing
+	// templates. Empty delimiters default to "{{" and "}}".
+	LeftDelim, RightDelim string
+
+	// ErrorLog specifies an optional logger for panics recovered while
+	// serving requests and templates which fail to load. If nil, logging is done via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	// Observer, if set, is notified of each template loaded and rendered.
+	Observer Observer
+
+	// ServeStale causes the previously cached version of a template to
+	// continue to be served when, in DevMode, its changed file fails to
+	// parse. The error is logged and the template is parsed again once its
+	// file next changes. If the file is removed, the template is no longer
+	// served. Otherwise, the parse error is reported as for a missing
+	// template until it is fixed.
+	ServeStale bool
+
+	// MissingKey controls the behaviour of templates when indexing the data
+	// map with a key it does not contain, as with the "missingkey" option
+	// of text/template: "default" or "invalid" prints "<no value>", "zero"
+	// returns the zero value and "error" stops execution with an error,
+	// which is handled as any other execution error. Empty uses the
+	// default.
+	MissingKey string
+
+	// DevMode causes the modification time of each cached template to be
+	// checked on every request, re-parsing the template whenever its file
+	// has changed. The include root is also checked, and if any file within
+	// it has been added, removed or changed, the includes are reloaded and
+	// all cached templates discarded, as by Reload. This eases development
+	// at the cost of filesystem accesses on every request, and should not
+	// be used in production.
+	DevMode bool
+
+	// LiveReload, in DevMode only, causes open pages to reload themselves
+	// whenever a file in the document or include root changes. A script
+	// is injected before the closing body tag of each buffered HTML
+	// response, which listens for a reload event from the Server-Sent
+	// Events endpoint served at LiveReloadPath. Each open page polls the
+	// filesystem, so LiveReload, like DevMode, must never be used in
+	// production. The endpoint is relative to the root of the server, so
+	// LiveReload does not work if the server is mounted below it.
+	LiveReload bool
+
+	broker       DataBroker
+	mut          sync.RWMutex // protects templates, loads, includes, base, funcs, cacheControl, middleware and handler
+	templates    map[string]*cachedTemplate
+	loads        map[string]*templateLoad
+	base         *includeBase                      // parsed includes, nil until first load
+	funcs        pathPatterns[template.FuncMap]    // per-path functions
+	cacheControl pathPatterns[string]              // per-path Cache-Control headers
+	middleware   []func(http.Handler) http.Handler // registered by Use, in order
+	handler      http.Handler                      // middleware chain around handle, nil if none
+	fsys         fs.FS                             // document root
+	root         string                            // document root on disk, if any
+	roots        []string                          // document roots on disk, if more than one
+	incfs        fs.FS                             // include root
+	incroot      string                            // include root on disk, if any
+	incdir       string                            // include root within incfs
+	includes     []string                          // include template paths within incfs
+	incstamp     dirStamp                          // state of the include root when loaded
 }
 
 func sanitizePath(p string) string {
@@ -67,125 +684,1881 @@ func verifyDirectory(dir string) bool {
 	return true
 }
 
-// loadIncludes traverses and loads any potential include templates
-// from the includeRoot at path.
-func (srv *TemplateServer) loadIncludes(path string) error {
-	entries, err := os.ReadDir(path)
-	if os.IsNotExist(err) || errors.Is(err, os.ErrInvalid) {
-		return ErrIncludesInvalid
+// verifyDirectoryFS checks if a path exists within fsys and is a directory.
+func verifyDirectoryFS(fsys fs.FS, dir string) bool {
+	info, err := fs.Stat(fsys, dir)
+	if err != nil {
+		return false
 	}
 
-	for _, elem := range entries {
-		if elem.Type().IsDir() {
-			err = srv.loadIncludes(filepath.Join(path, elem.Name()))
-			if err != nil {
-				return err
-			}
+	return info.IsDir()
+}
 
-			continue
+// globEscape escapes any pattern metacharacters in names, such that they can
+// be passed to ParseFS as literal paths.
+func globEscape(names ...string) []string {
+	esc := make([]string, len(names))
+	for i, elem := range names {
+		var b strings.Builder
+		for _, c := range elem {
+			if strings.ContainsRune(`*?[\`, c) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(c)
 		}
+		esc[i] = b.String()
+	}
+
+	return esc
+}
 
-		srv.includes = append(srv.includes, filepath.Join(path, elem.Name()))
+// withinRoot reports whether p, once all symbolic links have been resolved,
+// lies inside the directory root.
+func withinRoot(root, p string) bool {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	p, err = filepath.EvalSymlinks(p)
+	if err != nil {
+		return false
 	}
 
-	return nil
+	return lexicallyWithin(root, p)
 }
 
-// loadTemplate loads and caches (thread safely) a template file located
-// at path.
-func (srv *TemplateServer) loadTemplate(path string) error {
-	if srv.templates == nil {
-		srv.templates = make(map[string]*template.Template)
+// lexicallyWithin reports whether the path p lies inside the directory root,
+// without resolving symbolic links.
+func lexicallyWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
 	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
-	files := make([]string, 0, len(srv.includes)+1)
-	files = append(files, srv.includes...)
-	files = append(files, filepath.Join(srv.root, path))
+// loadIncludes traverses and loads any potential include templates
+// from the includeRoot at path, which must be a directory, but may be empty.
+func (srv *TemplateServer) loadIncludes(path string) error {
+	if !verifyDirectory(path) {
+		return ErrIncludesInvalid
+	}
 
-	srv.mut.Lock()
-	defer srv.mut.Unlock()
+	srv.incroot = path
+	return srv.loadIncludesFS(os.DirFS(path), ".")
+}
 
-	_, ok := srv.templates[path]
-	if ok {
-		return ErrAlreadyParsed
+// loadIncludesFS traverses and loads any potential include templates from
+// the directory dir within fsys.
+func (srv *TemplateServer) loadIncludesFS(fsys fs.FS, dir string) error {
+	if !verifyDirectoryFS(fsys, dir) {
+		return ErrIncludesInvalid
 	}
 
-	var err error
-	srv.templates[path], err = template.New(path).ParseFiles(files...)
+	srv.incfs = fsys
+	srv.incdir = dir
+
+	srv.incstamp = srv.includeStamp()
+	err := srv.walkIncludes(dir, 0, nil)
 	if err != nil {
-		delete(srv.templates, path)
 		return err
 	}
+	return srv.checkIncludes()
+}
 
-	return nil
+// dirStamp summarises the state of a directory tree, such that adding,
+// removing or modifying any file within it changes the stamp.
+type dirStamp struct {
+	files   int
+	modTime int64 // latest modification time, in Unix nanoseconds
 }
 
-// ServeHTTP loads, parses (if not already cached) and serves a template
-// specified in the requests URL. Can be safely called in parallel, as is
-// done by http.Server.
-func (srv *TemplateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/" {
-		r.URL.Path = "/index.gohtml"
+// stampDir returns the current stamp of the directory dir within fsys.
+func stampDir(fsys fs.FS, dir string) dirStamp {
+	var stamp dirStamp
+	fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		stamp.files++
+		if mt := info.ModTime().UnixNano(); mt > stamp.modTime {
+			stamp.modTime = mt
+		}
+		return nil
+	})
+
+	return stamp
+}
+
+// includeStamp returns the current stamp of the include root.
+func (srv *TemplateServer) includeStamp() dirStamp {
+	return stampDir(srv.incfs, srv.incdir)
+}
+
+// refreshIncludes reloads the includes, discarding all cached templates, if
+// in DevMode the include root has changed since they were loaded.
+func (srv *TemplateServer) refreshIncludes() {
+	if !srv.DevMode || srv.incfs == nil {
+		return
 	}
-	p := sanitizePath(r.URL.Path)
 
+	stamp := srv.includeStamp()
 	srv.mut.RLock()
-	defer srv.mut.RUnlock()
-	if _, ok := srv.templates[p]; !ok {
-		srv.mut.RUnlock()
-		err := srv.loadTemplate(p)
-		srv.mut.RLock()
+	changed := stamp != srv.incstamp
+	srv.mut.RUnlock()
 
-		if err != nil {
-			http.Error(w, "404 not found", http.StatusNotFound)
-			return
+	if changed {
+		if err := srv.Reload(); err != nil {
+			srv.logf("gtemplate: reloading includes: %s", err)
+		}
+	}
+}
+
+// includeName returns the template name of the include at p.
+func (srv *TemplateServer) includeName(p string) string {
+	if !srv.NamespaceIncludes {
+		return path.Base(p)
+	}
+	if srv.incdir == "." {
+		return p
+	}
+
+	return strings.TrimPrefix(p, srv.incdir+"/")
+}
+
+// checkIncludes returns an error naming the files if two includes would be
+// parsed as templates of the same name, one silently replacing the other.
+func (srv *TemplateServer) checkIncludes() error {
+	seen := make(map[string]string, len(srv.includes))
+	for _, elem := range srv.includes {
+		name := srv.includeName(elem)
+		if prev, ok := seen[name]; ok {
+			return fmt.Errorf("%w %q: %s and %s", ErrIncludesClash, name, prev, elem)
 		}
+		seen[name] = elem
 	}
 
-	data := srv.broker.Data(p)
-	err := srv.templates[p].ExecuteTemplate(w, path.Base(p), data)
+	return nil
+}
+
+// maxIncludeDepth returns the maximum depth of include directories.
+func (srv *TemplateServer) maxIncludeDepth() int {
+	if srv.MaxIncludeDepth != 0 {
+		return srv.MaxIncludeDepth
+	}
+
+	return DefaultMaxIncludeDepth
+}
+
+// walkIncludes recursively collects include templates below dir, which is
+// depth directories below the include root. Parents holds each directory
+// visited on the way to dir and is used to detect symbolic link loops.
+func (srv *TemplateServer) walkIncludes(dir string, depth int, parents []fs.FileInfo) error {
+	if depth > srv.maxIncludeDepth() {
+		return ErrIncludesDepth
+	}
 
+	info, err := fs.Stat(srv.incfs, dir)
 	if err != nil {
-		http.Error(w, "500 internal error\n\t"+err.Error(), http.StatusInternalServerError)
+		return ErrIncludesInvalid
+	}
+	for _, elem := range parents {
+		if os.SameFile(elem, info) {
+			return ErrIncludesLoop
+		}
+	}
+	parents = append(parents, info)
+
+	entries, err := fs.ReadDir(srv.incfs, dir)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		return ErrIncludesInvalid
+	}
+
+	for _, elem := range entries {
+		p := path.Join(dir, elem.Name())
+
+		isDir := elem.IsDir()
+		if elem.Type()&fs.ModeSymlink != 0 {
+			if !srv.FollowSymlinks && srv.incroot != "" &&
+				!withinRoot(srv.incroot, filepath.Join(srv.incroot, filepath.FromSlash(p))) {
+				continue
+			}
+
+			info, err := fs.Stat(srv.incfs, p)
+			isDir = err == nil && info.IsDir()
+		}
+
+		if isDir {
+			err = srv.walkIncludes(p, depth+1, parents)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if srv.IncludePattern != "" {
+			ok, err := path.Match(srv.IncludePattern, elem.Name())
+			if err != nil {
+				return ErrIncludesPattern
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		srv.includes = append(srv.includes, p)
 	}
+
+	return nil
 }
 
-// NewServer instantiates a new TemplateServer instance which can be
-// used with http.Server as a handler.
-func NewServer(root string, data DataBroker) (http.Handler, error) {
-	if !verifyDirectory(root) {
-		return nil, ErrRootInvalid
+// isText reports whether the template at path is rendered as plain text.
+func (srv *TemplateServer) isText(path string) bool {
+	if srv.TextMode {
+		return true
 	}
-	if data == nil {
-		data = DefaultDataBroker
+	if v, ok := srv.variant(path); ok && v.Text {
+		return true
 	}
 
-	srv := &TemplateServer{
-		broker:    data,
-		templates: make(map[string]*template.Template),
-		root:      root,
+	for _, elem := range srv.TextPaths {
+		if sanitizePath(elem) == path {
+			return true
+		}
 	}
 
-	return srv, nil
+	return false
 }
 
-// NewIncludesServer instantiates a new TemplateServer instance with includes
-// support, meaning that templates in includeRoot can be used by any other
-// executing template. Templates in the root still cannot execute each other.
-// The instance can be used with http.Server as a handler. Error is returned if
-// root or includeRoot are invalid directories.
-func NewIncludesServer(root string, includeRoot string, data DataBroker) (http.Handler, error) {
-	if data == nil {
-		data = DefaultDataBroker
+// includeBase holds the include templates parsed once, on first use, as the
+// base of each template set. Each template is parsed onto a clone of the base
+// rather than re-reading and re-parsing every include, which
+// BenchmarkLoadTemplate shows to take around a third of the time. A single
+// set shared by every template would avoid even the clone, but html/template
+// forbids parsing into a set once any of it has executed, and pages could
+// not define templates of the same name, such as the blocks of a layout.
+//
+// The base itself is never executed, only cloned, and so remains valid to
+// clone for as long as it is in use. Cloning only reads the base, and so is
+// safe from concurrent loads; each clone is then owned by a single template
+// set.
+type includeBase struct {
+	paths []string // include template paths within the server's incfs
+
+	htmlOnce sync.Once
+	html     *template.Template
+	htmlErr  error
+
+	textOnce sync.Once
+	text     *texttemplate.Template
+	textErr  error
+
+	// Under SharedRoot, the templates of the document root parsed onto
+	// the includes, and the stamp of the root when the base was created,
+	// in DevMode only
+	rootOnce sync.Once
+	root     *template.Template
+	rootErr  error
+	stamp    dirStamp
+}
+
+// baseName is the name of the root of each template set. It contains a slash
+// so as not to collide with the name of any parsed file.
+const baseName = "/base"
+
+// htmlBase returns a fresh clone of the HTML include templates.
+func (srv *TemplateServer) htmlBase(b *includeBase) (*template.Template, error) {
+	b.htmlOnce.Do(func() {
+		t := srv.newHTML(baseName)
+		if srv.MissingKey != "" {
+			t.Option("missingkey=" + srv.MissingKey)
+		}
+		for _, elem := range b.paths {
+			var text []byte
+			text, b.htmlErr = fs.ReadFile(srv.incfs, elem)
+			if b.htmlErr != nil {
+				break
+			}
+			_, b.htmlErr = t.New(srv.includeName(elem)).Parse(string(text))
+			if b.htmlErr != nil {
+				break
+			}
+		}
+		b.html = t
+	})
+	if b.htmlErr != nil {
+		return nil, b.htmlErr
 	}
 
-	srv := &TemplateServer{
-		broker:    data,
-		templates: make(map[string]*template.Template),
-		root:      root,
+	return b.html.Clone()
+}
+
+// textBase returns a fresh clone of the text include templates.
+func (srv *TemplateServer) textBase(b *includeBase) (*texttemplate.Template, error) {
+	b.textOnce.Do(func() {
+		t := texttemplate.New(baseName).
+			Funcs(texttemplate.FuncMap(srv.Funcs)).
+			Delims(srv.LeftDelim, srv.RightDelim)
+		if srv.MissingKey != "" {
+			t.Option("missingkey=" + srv.MissingKey)
+		}
+		for _, elem := range b.paths {
+			var text []byte
+			text, b.textErr = fs.ReadFile(srv.incfs, elem)
+			if b.textErr != nil {
+				break
+			}
+			_, b.textErr = t.New(srv.includeName(elem)).Parse(string(text))
+			if b.textErr != nil {
+				break
+			}
+		}
+		b.text = t
+	})
+	if b.textErr != nil {
+		return nil, b.textErr
+	}
+
+	return b.text.Clone()
+}
+
+// sharedBase returns the set of all HTML templates in the document root and
+// the includes, parsed on first use, under SharedRoot. Each template of the
+// root is named by its path relative to the root. Unlike htmlBase, the set is
+// returned itself rather than a clone, and is executed directly.
+func (srv *TemplateServer) sharedBase(b *includeBase) (*template.Template, error) {
+	b.rootOnce.Do(func() {
+		t, err := srv.htmlBase(b)
+		if err != nil {
+			b.rootErr = err
+			return
+		}
+
+		for _, p := range srv.Templates() {
+			name := strings.TrimPrefix(p, "/")
+			if srv.isText(p) || !srv.inRoot(name) {
+				continue
+			}
+
+			var text []byte
+			text, err = fs.ReadFile(srv.fsys, name)
+			if err == nil {
+				_, err = t.New(name).Parse(string(text))
+			}
+			if err != nil {
+				b.rootErr = err
+				return
+			}
+		}
+		b.root = t
+	})
+
+	return b.root, b.rootErr
+}
+
+// parse parses the template file name within the document root, along with
+// the layout if used, onto a clone of the include templates, creating a new
+// template set for p.
+func (srv *TemplateServer) parse(p, name string, base *includeBase) (*cachedTemplate, error) {
+	switch srv.MissingKey {
+	case "", "default", "invalid", "zero", "error":
+	default:
+		return nil, ErrMissingKey
+	}
+
+	if srv.SharedRoot && !srv.isText(p) {
+		t, err := srv.sharedBase(base)
+		if err != nil {
+			return nil, err
+		}
+		// Templates added since the set was parsed are parsed alone
+		if t.Lookup(name) != nil {
+			return &cachedTemplate{renderer: t, name: name, shared: base}, nil
+		}
+	}
+
+	if srv.isText(p) {
+		t, err := srv.textBase(base)
+		if err != nil {
+			return nil, err
+		}
+
+		t.Funcs(texttemplate.FuncMap(srv.funcsFor(p)))
+		_, err = t.ParseFS(srv.fsys, globEscape(name)...)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedTemplate{renderer: t, name: path.Base(name)}, nil
+	}
+
+	t, err := srv.htmlBase(base)
+	if err != nil {
+		return nil, err
+	}
+
+	funcs := srv.funcsFor(p)
+	t.Funcs(funcs)
+
+	files := []string{name}
+	if srv.Layout != "" {
+		layout := strings.TrimPrefix(sanitizePath(srv.Layout), "/")
+		if layout != name {
+			uses, err := srv.usesLayout(name, layout, funcs)
+			if err != nil {
+				return nil, err
+			}
+			if uses {
+				// Layout is parsed first, so that the page's
+				// definitions replace its default blocks
+				files = []string{layout, name}
+			}
+		}
+	}
+
+	_, err = t.ParseFS(srv.fsys, globEscape(files...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedTemplate{renderer: t, name: path.Base(files[0])}, nil
+}
+
+// newHTML returns a new HTML template with the server's functions and
+// delimiters.
+func (srv *TemplateServer) newHTML(name string) *template.Template {
+	return template.New(name).Funcs(srv.Funcs).Delims(srv.LeftDelim, srv.RightDelim)
+}
+
+// usesLayout reports whether the page at name defines any template also
+// defined by the layout, in which case the page is rendered within the
+// layout. Funcs are the page's per-path functions.
+func (srv *TemplateServer) usesLayout(name, layout string, funcs template.FuncMap) (bool, error) {
+	lt, err := srv.newHTML(path.Base(layout)).Funcs(funcs).ParseFS(srv.fsys, globEscape(layout)...)
+	if err != nil {
+		return false, err
+	}
+	pt, err := srv.newHTML(path.Base(name)).Funcs(funcs).ParseFS(srv.fsys, globEscape(name)...)
+	if err != nil {
+		return false, err
+	}
+
+	for _, elem := range pt.Templates() {
+		if elem.Name() != path.Base(name) && lt.Lookup(elem.Name()) != nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// pathPatterns maps path patterns to values. As with the patterns of Broker,
+// a pattern may be the path of a single template, a directory ending in a
+// slash applying to all templates below it, or contain glob metacharacters
+// as understood by path.Match.
+type pathPatterns[V any] struct {
+	exact map[string]V // by template path or directory
+	globs []globValue[V]
+}
+
+// globValue is a value registered for a glob pattern.
+type globValue[V any] struct {
+	pattern string
+	v       V
+}
+
+// set registers v for pattern, panicking if the pattern is malformed.
+func (pp *pathPatterns[V]) set(pattern string, v V) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic("gtemplate: malformed path pattern")
+	}
+
+	if isGlob(pattern) {
+		pp.globs = append(pp.globs, globValue[V]{pattern, v})
+		return
+	}
+	if pp.exact == nil {
+		pp.exact = make(map[string]V)
+	}
+	pp.exact[pattern] = v
+}
+
+// match returns the values whose patterns match p, in increasing order of
+// precedence: those for each enclosing directory from the root down, then
+// that for p itself or, failing that, the first matching glob.
+func (pp *pathPatterns[V]) match(p string) []V {
+	if len(pp.exact) == 0 && len(pp.globs) == 0 {
+		return nil
+	}
+
+	var chain []V
+	for i := 0; i < len(p)-1; i++ {
+		if p[i] != '/' {
+			continue
+		}
+		if v, ok := pp.exact[p[:i+1]]; ok {
+			chain = append(chain, v)
+		}
+	}
+
+	if v, ok := pp.exact[p]; ok {
+		return append(chain, v)
+	}
+	for _, elem := range pp.globs {
+		if ok, _ := path.Match(elem.pattern, p); ok {
+			return append(chain, elem.v)
+		}
+	}
+
+	return chain
+}
+
+// FuncsFor makes the functions in funcs available to the templates matching
+// pattern, in addition to those in Funcs, such as to provide helpers only to
+// one section of a site. As with the patterns of Broker, a pattern may be the
+// path of a single template, a directory ending in a slash applying to all
+// templates below it, or contain glob metacharacters as understood by
+// path.Match.
+//
+// Functions for a directory are inherited by the templates below it, with
+// more specific directories taking precedence, followed by the functions for
+// the template's own path or, failing that, the first matching glob. Any
+// function of the same name in Funcs is replaced. The functions are not
+// available to includes, which are shared by all templates.
+//
+// Templates already cached are discarded, to be parsed again with the
+// functions when next requested. FuncsFor panics if pattern is malformed.
+func (srv *TemplateServer) FuncsFor(pattern string, funcs template.FuncMap) {
+	srv.mut.Lock()
+	defer srv.mut.Unlock()
+
+	srv.funcs.set(pattern, funcs)
+	srv.templates = make(map[string]*cachedTemplate)
+}
+
+// funcsFor returns the per-path functions for the template at p, merged in
+// order of precedence, followed by those of a FuncDataBroker, or nil if
+// there are none.
+func (srv *TemplateServer) funcsFor(p string) template.FuncMap {
+	srv.mut.RLock()
+	chain := srv.funcs.match(p)
+	srv.mut.RUnlock()
+
+	if fb, ok := srv.broker.(FuncDataBroker); ok {
+		chain = append(chain, fb.Funcs(p))
+	}
+	if chain == nil {
+		return nil
+	}
+
+	funcs := make(template.FuncMap)
+	for _, fm := range chain {
+		for k, v := range fm {
+			funcs[k] = v
+		}
+	}
+	return funcs
+}
+
+// SetCacheControl sets the Cache-Control header sent with the templates
+// matching pattern to value, such as "public, max-age=86400" or "no-cache".
+// Patterns are as accepted by FuncsFor, with the most specific matching
+// pattern taking precedence. An empty value sends no header for matching
+// templates, overriding any less specific pattern. By default, no
+// Cache-Control header is sent. A template's data may replace the header
+// using HeadersKey. SetCacheControl panics if pattern is malformed.
+func (srv *TemplateServer) SetCacheControl(pattern, value string) {
+	srv.mut.Lock()
+	defer srv.mut.Unlock()
+
+	srv.cacheControl.set(pattern, value)
+}
+
+// cacheControlFor returns the Cache-Control header for the template at p.
+func (srv *TemplateServer) cacheControlFor(p string) string {
+	srv.mut.RLock()
+	defer srv.mut.RUnlock()
+
+	chain := srv.cacheControl.match(p)
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[len(chain)-1]
+}
+
+// inRoot reports whether the file at name within the document root may be
+// served, being neither outside the root nor, unless FollowSymlinks is set,
+// a symbolic link leading outside it.
+func (srv *TemplateServer) inRoot(name string) bool {
+	if !fs.ValidPath(name) {
+		return false
+	}
+	root := srv.root
+	if len(srv.roots) > 0 {
+		// Checked against the root from which the file would be loaded
+		if i := srv.layer(name); i >= 0 {
+			root = srv.roots[i]
+		}
+	}
+	if root != "" {
+		// Guards against traversal regardless of symbolic links
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if !lexicallyWithin(root, p) || (!srv.FollowSymlinks && !withinRoot(root, p)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// loadTemplate loads and parses a template file located at path.
+func (srv *TemplateServer) loadTemplate(path string) (*cachedTemplate, error) {
+	name := strings.TrimPrefix(path, "/")
+	if !srv.inRoot(name) {
+		return nil, os.ErrNotExist
+	}
+
+	info, err := fs.Stat(srv.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	// In DevMode, the shared set is parsed afresh once the root changes
+	var stamp dirStamp
+	if srv.SharedRoot && srv.DevMode {
+		stamp = stampDir(srv.fsys, ".")
+	}
+
+	srv.mut.Lock()
+	if srv.base == nil || srv.base.stamp != stamp {
+		srv.base = &includeBase{paths: srv.includes, stamp: stamp}
+	}
+	base := srv.base
+	srv.mut.Unlock()
+
+	t, err := srv.parse(path, name, base)
+	if err != nil {
+		return nil, templateError(path, err)
+	}
+
+	// The cached set is kept unexecuted, so that it may be cloned
+	if _, ok := srv.broker.(FuncDataBroker); ok && t.shared == nil {
+		t.sets, err = newFuncSets(t.renderer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.modTime = info.ModTime()
+	t.layer = srv.layer(name)
+	return t, nil
+}
+
+// stale reports whether the cached template t for path must be re-parsed,
+// which is only the case in DevMode when its file, or any file of the root
+// under SharedRoot, has since changed.
+func (srv *TemplateServer) stale(path string, t *cachedTemplate) bool {
+	if !srv.DevMode {
+		return false
+	}
+	if t.shared != nil && stampDir(srv.fsys, ".") != t.shared.stamp {
+		return true
+	}
+
+	name := strings.TrimPrefix(path, "/")
+	info, err := fs.Stat(srv.fsys, name)
+	return err != nil || !info.ModTime().Equal(t.modTime) || srv.layer(name) != t.layer
+}
+
+// cached returns the template cached for path, if any. Stale templates are
+// still returned, but with ok false.
+func (srv *TemplateServer) cached(path string) (t *cachedTemplate, ok bool) {
+	srv.mut.RLock()
+	t, ok = srv.templates[path]
+	srv.mut.RUnlock()
+
+	if ok && srv.MaxCached > 0 {
+		srv.touch(t)
+	}
+	return t, ok && !srv.stale(path, t)
+}
+
+// touch marks t as the most recently used template.
+func (srv *TemplateServer) touch(t *cachedTemplate) {
+	atomic.StoreUint64(&t.used, atomic.AddUint64(&srv.stats.clock, 1))
+}
+
+// evict removes the least recently used templates from the cache until it
+// holds no more than MaxCached. The caller must hold mut.
+func (srv *TemplateServer) evict() {
+	for srv.MaxCached > 0 && len(srv.templates) > srv.MaxCached {
+		var (
+			lru  string
+			used uint64
+			ok   bool
+		)
+		for p, t := range srv.templates {
+			if u := atomic.LoadUint64(&t.used); !ok || u < used {
+				lru, used, ok = p, u, true
+			}
+		}
+
+		delete(srv.templates, lru)
+		atomic.AddUint64(&srv.stats.evictions, 1)
+	}
+}
+
+// templateLoad is an in-progress load of a template, shared by all requests
+// for the same uncached path until it completes.
+type templateLoad struct {
+	done chan struct{}
+	t    *cachedTemplate
+	err  error
+}
+
+// template returns the cached template for path, loading and caching it
+// first if it has not yet been parsed or is stale. Concurrent requests for
+// the same uncached path wait for a single load rather than each parsing the
+// template, and loads of different paths proceed in parallel.
+func (srv *TemplateServer) template(path string) (*cachedTemplate, error) {
+	t, ok := srv.cached(path)
+	if ok {
+		return t, nil
+	}
+
+	srv.mut.Lock()
+	// Another request may have loaded or replaced the template meanwhile
+	if t2, ok := srv.templates[path]; ok && t2 != t {
+		srv.mut.Unlock()
+		return t2, nil
+	}
+	if l, ok := srv.loads[path]; ok {
+		srv.mut.Unlock()
+
+		<-l.done
+		return l.t, l.err
+	}
+
+	l := &templateLoad{done: make(chan struct{})}
+	if srv.loads == nil {
+		srv.loads = make(map[string]*templateLoad)
+	}
+	srv.loads[path] = l
+	srv.mut.Unlock()
+
+	start := time.Now()
+	l.t, l.err = srv.loadTemplate(path)
+	if srv.Observer != nil {
+		srv.Observer.OnLoad(path, time.Since(start), l.err)
+	}
+	if l.err != nil && t != nil && srv.ServeStale && !errors.Is(l.err, fs.ErrNotExist) {
+		srv.logf("gtemplate: reloading %s: %s; serving previous version", path, l.err)
+
+		// Not retried until the file changes again
+		st := cachedTemplate{renderer: t.renderer, name: t.name, modTime: t.modTime, layer: t.layer, sets: t.sets}
+		if info, err := fs.Stat(srv.fsys, strings.TrimPrefix(path, "/")); err == nil {
+			st.modTime = info.ModTime()
+		}
+		l.t, l.err = &st, nil
+	}
+
+	srv.mut.Lock()
+	delete(srv.loads, path)
+	if l.err == nil {
+		if srv.templates == nil {
+			srv.templates = make(map[string]*cachedTemplate)
+		}
+		srv.templates[path] = l.t
+		if srv.MaxCached > 0 {
+			srv.touch(l.t)
+			srv.evict()
+		}
+	} else {
+		delete(srv.templates, path)
+	}
+	srv.mut.Unlock()
+	close(l.done)
+
+	return l.t, l.err
+}
+
+// index returns the file name of a directory's index template.
+func (srv *TemplateServer) index() string {
+	if srv.Index != "" {
+		return srv.Index
+	}
+
+	return "index" + srv.Extension
+}
+
+// templatePath returns the sanitized path of the template requested by the
+// URL path p, naming the index template for directories, or the
+// RootTemplate, if set, for the root.
+func (srv *TemplateServer) templatePath(p string) string {
+	sp := sanitizePath(p)
+	if sp == "/" && srv.RootTemplate != "" {
+		return sanitizePath(srv.RootTemplate)
+	}
+	if sp == "/" || strings.HasSuffix(p, "/") {
+		sp = path.Join(sp, srv.index())
+	}
+
+	return sp
+}
+
+// requestPath returns the path of the template requested by r, as
+// templatePath, matched to the files of the document root if
+// CaseInsensitive is set.
+func (srv *TemplateServer) requestPath(r *http.Request) string {
+	p := srv.templatePath(r.URL.Path)
+	if srv.CaseInsensitive {
+		p = srv.foldPath(p)
+	}
+
+	return p
+}
+
+// foldPath returns the template path p with each element which does not
+// exist replaced by the name of the first file in its directory matching it
+// case insensitively. The last element may also match a template named for
+// it with the template extension, in which case the extension is omitted,
+// as for clean URLs. Elements matching no file are left unchanged, as are
+// those following them.
+func (srv *TemplateServer) foldPath(p string) string {
+	elems := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	dir := "."
+	for i, elem := range elems {
+		name := path.Join(dir, elem)
+		if _, err := fs.Stat(srv.fsys, name); err != nil {
+			match, ok := srv.foldName(dir, elem, i == len(elems)-1)
+			if !ok {
+				break
+			}
+
+			elems[i] = match
+			name = path.Join(dir, match)
+		}
+		dir = name
+	}
+
+	return "/" + strings.Join(elems, "/")
+}
+
+// foldName returns the name of the first file in dir matching elem case
+// insensitively, preferring an exact match to one with the template
+// extension added if last is set.
+func (srv *TemplateServer) foldName(dir, elem string, last bool) (string, bool) {
+	entries, err := fs.ReadDir(srv.fsys, dir)
+	if err != nil {
+		return "", false
+	}
+
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), elem) {
+			return e.Name(), true
+		}
+	}
+	if last && srv.Extension != "" && path.Ext(elem) == "" {
+		for _, e := range entries {
+			if strings.EqualFold(e.Name(), elem+srv.Extension) {
+				return e.Name()[:len(e.Name())-len(srv.Extension)], true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// router is a DataBroker which matches paths against parameterized route
+// patterns, such as Broker.
+type router interface {
+	Route(path string) (pattern string, params map[string]string, ok bool)
+}
+
+// resolve returns the template for the request path p, along with the path
+// it was resolved to and whether it was already cached. Paths without an
+// extension which do not name a template are retried with the template
+// extension appended, allowing clean URLs. If the broker is a router, paths
+// matching a parameterized route are first resolved to the template at the
+// route's pattern.
+func (srv *TemplateServer) resolve(p string) (string, *cachedTemplate, bool, error) {
+	clean := srv.Extension != "" && path.Ext(p) == ""
+
+	if rt, ok := srv.broker.(router); ok {
+		candidates := []string{p}
+		if clean {
+			candidates = append(candidates, p+srv.Extension)
+		}
+
+		for _, elem := range candidates {
+			if pattern, _, ok := rt.Route(elem); ok {
+				if t, ok := srv.cached(pattern); ok {
+					return elem, t, true, nil
+				}
+				if t, err := srv.template(pattern); err == nil {
+					return elem, t, false, nil
+				}
+			}
+		}
+	}
+
+	if t, ok := srv.cached(p); ok {
+		return p, t, true, nil
+	}
+	if clean {
+		if t, ok := srv.cached(p + srv.Extension); ok {
+			return p + srv.Extension, t, true, nil
+		}
+	}
+
+	t, err := srv.template(p)
+	if err != nil && clean {
+		et, eerr := srv.template(p + srv.Extension)
+		if eerr == nil {
+			return p + srv.Extension, et, false, nil
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			// Reports why the template the clean URL names failed
+			err = eerr
+		}
+	}
+
+	return p, t, false, err
+}
+
+// canonical returns the location to which the request r for a missing
+// template is redirected under TrailingSlashRedirect, being its path with
+// the trailing slash removed or added, if that names a template.
+func (srv *TemplateServer) canonical(r *http.Request) (string, bool) {
+	p := r.URL.Path
+	if srv.TrailingSlashRedirect == 0 || p == "" || p == "/" {
+		return "", false
+	}
+
+	alt := p + "/"
+	if strings.HasSuffix(p, "/") {
+		alt = strings.TrimRight(p, "/")
+	}
+	if alt == "" || !srv.Has(alt) {
+		return "", false
+	}
+
+	if r.URL.RawQuery != "" {
+		alt += "?" + r.URL.RawQuery
+	}
+	return alt, true
+}
+
+// Has reports whether a template exists for the URL path p, as it would be
+// resolved by ServeHTTP, including by clean URLs and parameterized routes.
+// Cached templates are found without touching the filesystem; otherwise,
+// only the existence of the file is checked. No template is parsed or cached
+// as a side effect, and so a template which exists but fails to parse is
+// still reported; Warm or Validate find those. Has is safe to call
+// concurrently with requests.
+func (srv *TemplateServer) Has(p string) bool {
+	p = srv.templatePath(p)
+	candidates := []string{p}
+	if srv.Extension != "" && path.Ext(p) == "" {
+		candidates = append(candidates, p+srv.Extension)
+	}
+	if rt, ok := srv.broker.(router); ok {
+		for _, elem := range candidates {
+			if pattern, _, ok := rt.Route(elem); ok {
+				candidates = append(candidates, pattern)
+			}
+		}
+	}
+
+	for _, elem := range candidates {
+		if srv.exists(elem) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exists reports whether the template at p is cached or its file exists.
+func (srv *TemplateServer) exists(p string) bool {
+	if _, ok := srv.cached(p); ok {
+		return true
+	}
+
+	name := strings.TrimPrefix(p, "/")
+	if !srv.inRoot(name) {
+		return false
+	}
+
+	info, err := fs.Stat(srv.fsys, name)
+	return err == nil && !info.IsDir()
+}
+
+// withQuery returns a copy of data with the first value of each query
+// parameter added under QueryKey, unless data already has such a key.
+func withQuery(data map[string]interface{}, query url.Values) map[string]interface{} {
+	if _, ok := data[QueryKey]; ok {
+		return data
+	}
+
+	params := make(map[string]string, len(query))
+	for k, v := range query {
+		if len(v) > 0 {
+			params[k] = v[0]
+		}
+	}
+
+	dat := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		dat[k] = v
+	}
+	dat[QueryKey] = params
+
+	return dat
+}
+
+// newNonce returns a new random nonce for a Content-Security-Policy. The URL
+// safe encoding is used so that the nonce is not escaped within templates.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// withCookies returns a copy of data with the cookies accepted by filter, or
+// all if nil, added under CookiesKey, unless data already has such a key.
+func withCookies(data map[string]interface{}, cookies []*http.Cookie, filter func(string) bool) map[string]interface{} {
+	if _, ok := data[CookiesKey]; ok {
+		return data
+	}
+
+	values := make(map[string]string, len(cookies))
+	for _, elem := range cookies {
+		if filter != nil && !filter(elem.Name) {
+			continue
+		}
+		// The first of duplicate names is the most specific
+		if _, ok := values[elem.Name]; !ok {
+			values[elem.Name] = elem.Value
+		}
+	}
+
+	return withValue(data, CookiesKey, values)
+}
+
+// withValue returns a copy of data with v added under key.
+func withValue(data map[string]interface{}, key string, v interface{}) map[string]interface{} {
+	dat := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		dat[k] = v
+	}
+	dat[key] = v
+
+	return dat
+}
+
+// resolveContent resolves the layout template rendering the content file at
+// p, as for resolve, returning an error if the content file does not exist.
+func (srv *TemplateServer) resolveContent(p string, cl ContentLayout) (string, *cachedTemplate, bool, error) {
+	name := strings.TrimPrefix(p, "/")
+	if !srv.inRoot(name) {
+		return "", nil, false, os.ErrNotExist
+	}
+	if _, err := fs.Stat(srv.fsys, name); err != nil {
+		return "", nil, false, err
+	}
+
+	return srv.resolve(sanitizePath(cl.Layout))
+}
+
+// withContent returns a copy of data with the content file at p, converted
+// to HTML, added under ContentKey.
+func (srv *TemplateServer) withContent(data map[string]interface{}, p string, cl ContentLayout) (map[string]interface{}, error) {
+	src, err := fs.ReadFile(srv.fsys, strings.TrimPrefix(p, "/"))
+	if err != nil {
+		return nil, err
+	}
+	html, err := cl.Convert(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return withValue(data, ContentKey, html), nil
+}
+
+// data returns the broker's data for the template at p, served in response to
+// r.
+func (srv *TemplateServer) data(r *http.Request, p string) map[string]interface{} {
+	if _, ok := srv.broker.(AnyDataBroker); ok {
+		return nil
+	}
+	if rb, ok := srv.broker.(RequestDataBroker); ok {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		r2.URL.RawPath = ""
+
+		return rb.DataForRequest(r2)
+	}
+
+	return contextData(r.Context(), srv.broker, p)
+}
+
+// withDefaults returns the broker's data merged over DefaultData. The
+// result is never nil.
+func (srv *TemplateServer) withDefaults(data map[string]interface{}) map[string]interface{} {
+	if len(srv.DefaultData) == 0 {
+		if data == nil {
+			return make(map[string]interface{})
+		}
+		return data
+	}
+
+	dat := make(map[string]interface{}, len(srv.DefaultData)+len(data))
+	for k, v := range srv.DefaultData {
+		dat[k] = v
+	}
+	for k, v := range data {
+		dat[k] = v
+	}
+
+	return dat
+}
+
+// strict reports whether StrictData applies to the server's broker.
+func (srv *TemplateServer) strict() bool {
+	if _, ok := srv.broker.(AnyDataBroker); ok {
+		return false
+	}
+
+	return srv.StrictData
+}
+
+// pathData returns the broker's data for the template at p outside of any
+// request.
+func (srv *TemplateServer) pathData(p string) map[string]interface{} {
+	if _, ok := srv.broker.(AnyDataBroker); ok {
+		return nil
+	}
+
+	return contextData(context.Background(), srv.broker, p)
+}
+
+// dot returns the value with which to execute the template at p, being the
+// value from an AnyDataBroker, or otherwise the data map.
+func (srv *TemplateServer) dot(p string, data map[string]interface{}) interface{} {
+	if ab, ok := srv.broker.(AnyDataBroker); ok {
+		return ab.AnyData(p)
+	}
+
+	return data
+}
+
+// notFound responds to a request for the missing template at p, using the
+// NotFoundTemplate if one is set and loads and executes successfully. The
+// template is rendered with data if non-nil, else the data is fetched for p.
+func (srv *TemplateServer) notFound(w http.ResponseWriter, r *http.Request, p string, data map[string]interface{}) {
+	if srv.NotFoundTemplate != "" {
+		np := sanitizePath(srv.NotFoundTemplate)
+		if t, err := srv.template(np); err == nil {
+			if data == nil {
+				data, _ = extractDirectives(srv.withDefaults(srv.data(r, p)))
+			}
+
+			buf := getBuffer()
+			defer putBuffer(buf)
+
+			err = srv.execute(buf, np, t, srv.dot(p, data))
+			if err == nil {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				srv.writeBody(w, r, http.StatusNotFound, buf.Bytes())
+				return
+			}
+			srv.logf("gtemplate: rendering %s for %s: %s", np, p, err)
+		}
+	}
+
+	http.Error(w, "404 not found", http.StatusNotFound)
+}
+
+// brokerError returns the error reported by the broker in data, wrapping
+// ErrBrokerData, if ErrorTemplate is set. Otherwise, it returns nil.
+func (srv *TemplateServer) brokerError(data map[string]interface{}) error {
+	if srv.ErrorTemplate == "" {
+		return nil
+	}
+
+	msg, ok := data[ErrorKey]
+	if !ok {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %v", ErrBrokerData, msg)
+}
+
+// serveBrokerError responds to a request for the template at p, for which the
+// broker reported err in raw, using the ErrorTemplate if it loads and
+// executes successfully.
+func (srv *TemplateServer) serveBrokerError(w http.ResponseWriter, r *http.Request, p string, raw map[string]interface{}, err error) {
+	ep := sanitizePath(srv.ErrorTemplate)
+	t, terr := srv.template(ep)
+	if terr != nil {
+		srv.serveError(w, r, &fs.PathError{Op: "data", Path: p, Err: err})
+		return
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	data, _ := extractDirectives(srv.withDefaults(raw))
+	if terr := srv.execute(buf, ep, t, data); terr != nil {
+		srv.logf("gtemplate: rendering %s for %s: %s", ep, p, terr)
+		srv.serveError(w, r, &fs.PathError{Op: "data", Path: p, Err: err})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	srv.writeBody(w, r, http.StatusInternalServerError, buf.Bytes())
+}
+
+// contentType returns the Content-Type of the output of the template at p, or
+// the empty string if unknown.
+func (srv *TemplateServer) contentType(p string) string {
+	ext := strings.ToLower(path.Ext(p))
+	if ct, ok := srv.ContentTypes[ext]; ok {
+		return ct
+	}
+	if v, ok := srv.variant(p); ok {
+		return v.contentType()
+	}
+	if srv.isText(p) {
+		return "text/plain; charset=utf-8"
+	}
+	if ct, ok := DefaultContentTypes[ext]; ok {
+		return ct
+	}
+	if ext == srv.Extension {
+		return "text/html; charset=utf-8"
+	}
+
+	return mime.TypeByExtension(ext)
+}
+
+// setHeaders sets the response headers for a rendered template at p.
+func (srv *TemplateServer) setHeaders(w http.ResponseWriter, p string) {
+	if ct := srv.contentType(p); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if cc := srv.cacheControlFor(p); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+}
+
+// internalError sends the default response for a failed template execution.
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, "500 internal error\n\t"+err.Error(), http.StatusInternalServerError)
+}
+
+// ServeHTTP loads, parses (if not already cached) and serves a template
+// specified in the requests URL. Can be safely called in parallel, as is
+// done by http.Server. The request itself is never modified.
+//
+// HEAD requests are answered with the headers, including Content-Length, a
+// GET would receive, but no body. OPTIONS requests for an existing template
+// are answered with the allowed methods, without rendering. Requests using
+// any other method are refused with 405 Method Not Allowed, unless AnyMethod
+// is set.
+//
+// Requests pass through any middleware registered by Use first.
+func (srv *TemplateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if srv.RequestID {
+		r = withRequestID(w, r)
+	}
+
+	srv.mut.RLock()
+	h := srv.handler
+	srv.mut.RUnlock()
+
+	if h != nil {
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	srv.handle(w, r)
+}
+
+// Use registers middleware to be applied around the server's handling of
+// each request, such as for authentication or rate limiting. Middleware runs
+// in registration order, such that the first registered is outermost, and
+// may respond itself rather than calling the handler it wraps. As middleware
+// runs before RenderTimeout applies, time spent in middleware is not
+// limited by it. Use is safe to call concurrently with requests, which pass
+// through the middleware registered when they arrive, but mw is called with
+// the server locked, and so must not itself use the server.
+func (srv *TemplateServer) Use(mw func(http.Handler) http.Handler) {
+	srv.mut.Lock()
+	defer srv.mut.Unlock()
+
+	srv.middleware = append(srv.middleware, mw)
+
+	var h http.Handler = http.HandlerFunc(srv.handle)
+	for i := len(srv.middleware) - 1; i >= 0; i-- {
+		h = srv.middleware[i](h)
+	}
+	srv.handler = h
+}
+
+// handle serves r, as ServeHTTP, without middleware.
+func (srv *TemplateServer) handle(w http.ResponseWriter, r *http.Request) {
+	if srv.RenderTimeout > 0 && !(srv.DevMode && srv.LiveReload && r.URL.Path == LiveReloadPath) {
+		for k, v := range srv.SecurityHeaders {
+			w.Header().Set(k, v)
+		}
+
+		http.TimeoutHandler(http.HandlerFunc(srv.serve), srv.RenderTimeout, "503 render timed out").ServeHTTP(w, r)
+		return
+	}
+
+	srv.serve(w, r)
+}
+
+// serve serves r, as ServeHTTP, without any RenderTimeout.
+func (srv *TemplateServer) serve(w http.ResponseWriter, r *http.Request) {
+	defer srv.recover(w, r)
+	srv.refreshIncludes()
+	for k, v := range srv.SecurityHeaders {
+		w.Header().Set(k, v)
+	}
+
+	live := srv.DevMode && srv.LiveReload
+	if live && r.URL.Path == LiveReloadPath {
+		srv.serveLiveReload(w, r)
+		return
+	}
+
+	// Resolved once, as under CaseInsensitive each element may be listed
+	p := srv.requestPath(r)
+	if srv.isStatic(p) {
+		srv.serveStatic(w, r, p)
+		return
+	}
+
+	var (
+		tp  string // path of the template rendering p
+		t   *cachedTemplate
+		hit bool
+		err error
+	)
+	cl, content := srv.ContentLayouts[path.Ext(p)]
+	if content {
+		tp, t, hit, err = srv.resolveContent(p, cl)
+	} else {
+		p, t, hit, err = srv.resolve(p)
+		tp = p
+	}
+	if hit {
+		atomic.AddUint64(&srv.stats.hits, 1)
+	} else {
+		atomic.AddUint64(&srv.stats.misses, 1)
+	}
+	if err != nil {
+		if loc, ok := srv.canonical(r); ok {
+			http.Redirect(w, r, loc, srv.TrailingSlashRedirect)
+			return
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			srv.logf("gtemplate: loading %s: %s", tp, err)
+		}
+
+		srv.notFound(w, r, p, nil)
+		return
+	}
+	if len(srv.Variants) > 0 && !content {
+		w.Header().Add("Vary", "Accept")
+		if vp, vt, ok := srv.negotiate(r, p); ok {
+			tp, t = vp, vt
+		}
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+	case "OPTIONS":
+		w.Header().Set("Allow", allowedMethods)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		if !srv.AnyMethod {
+			w.Header().Set("Allow", allowedMethods)
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
+	raw := srv.data(r, p)
+	if raw == nil && srv.strict() {
+		srv.serveError(w, r, &fs.PathError{Op: "data", Path: p, Err: ErrNoData})
+		return
+	}
+	if err := srv.brokerError(raw); err != nil {
+		srv.serveBrokerError(w, r, p, raw, err)
+		return
+	}
+	data, d := extractDirectives(srv.withDefaults(raw))
+	if srv.QueryData {
+		data = withQuery(data, r.URL.Query())
+	}
+	if srv.CookieData {
+		data = withCookies(data, r.Cookies(), srv.CookieFilter)
+	}
+	if id, ok := RequestIDFromContext(r.Context()); ok && srv.RequestID {
+		data = withValue(data, RequestIDKey, id)
+	}
+	if srv.NoncePolicy != "" {
+		nonce, err := newNonce()
+		if err != nil {
+			srv.serveError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Security-Policy", strings.ReplaceAll(srv.NoncePolicy, NoncePlaceholder, nonce))
+		data = withValue(data, NonceKey, nonce)
+	}
+	if content {
+		data, err = srv.withContent(data, p, cl)
+		if err != nil {
+			srv.serveError(w, r, err)
+			return
+		}
+	}
+	switch {
+	case d.redirect != "":
+		d.apply(w)
+		status := d.status
+		if status < 300 || status > 399 {
+			status = http.StatusFound
+		}
+		http.Redirect(w, r, d.redirect, status)
+		return
+	case d.status == http.StatusNotFound:
+		d.apply(w)
+		srv.notFound(w, r, p, data)
+		return
+	}
+
+	if srv.LastModified && d.status == http.StatusOK {
+		lm := t.modTime
+		if content {
+			if info, err := fs.Stat(srv.fsys, strings.TrimPrefix(p, "/")); err == nil && info.ModTime().After(lm) {
+				lm = info.ModTime()
+			}
+		}
+		if d.modTime.After(lm) {
+			lm = d.modTime
+		}
+
+		if !lm.IsZero() {
+			w.Header().Set("Last-Modified", lm.UTC().Format(http.TimeFormat))
+			if notModified(r, lm) {
+				srv.setHeaders(w, tp)
+				d.apply(w)
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	if srv.Unbuffered {
+		srv.setHeaders(w, tp)
+		d.apply(w)
+
+		var out io.Writer = w
+		if srv.Compression {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		// Content cannot be sniffed once compressed
+		if srv.compress(r, -1) && w.Header().Get("Content-Type") != "" {
+			w.Header().Set("Content-Encoding", "gzip")
+
+			if r.Method != "HEAD" {
+				gz := gzip.NewWriter(w)
+				defer gz.Close()
+				out = gz
+			}
+		}
+		if d.status != http.StatusOK {
+			w.WriteHeader(d.status)
+		}
+		if r.Method == "HEAD" {
+			// Executed only to report errors
+			out = io.Discard
+		} else if f, ok := w.(http.Flusher); ok && srv.FlushInterval != 0 {
+			out = newFlushWriter(out, f, srv.FlushInterval)
+		}
+
+		err = srv.execute(out, tp, t, srv.dot(p, data))
+	} else {
+		// Returned only once the body has been written to w
+		buf := getBuffer()
+		defer putBuffer(buf)
+
+		err = srv.execute(buf, tp, t, srv.dot(p, data))
+		if err == nil {
+			srv.setHeaders(w, tp)
+			d.apply(w)
+
+			body := buf.Bytes()
+			if live && strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+				body = injectLiveReload(body, data[NonceKey])
+			}
+			srv.writeBody(w, r, d.status, body)
+		}
+	}
+
+	if err != nil {
+		srv.serveError(w, r, err)
+	}
+}
+
+// Render executes the template requested by the URL path p with the broker's
+// data, writing the output to w, such as to generate static files or emails
+// rather than serving HTTP. The path is resolved, and the template loaded and
+// cached, exactly as by ServeHTTP. Any error loading or executing the
+// template is returned. A broker setting StatusKey to 404 causes an error
+// satisfying errors.Is(err, fs.ErrNotExist); other reserved keys are ignored.
+func (srv *TemplateServer) Render(w io.Writer, p string) error {
+	srv.refreshIncludes()
+
+	var (
+		tp  string // path of the template rendering p
+		t   *cachedTemplate
+		err error
+	)
+	p = srv.templatePath(p)
+	cl, content := srv.ContentLayouts[path.Ext(p)]
+	if content {
+		tp, t, _, err = srv.resolveContent(p, cl)
+	} else {
+		p, t, _, err = srv.resolve(p)
+		tp = p
+	}
+	if err != nil {
+		return err
+	}
+
+	raw := srv.pathData(p)
+	if raw == nil && srv.strict() {
+		return &fs.PathError{Op: "data", Path: p, Err: ErrNoData}
+	}
+	if err := srv.brokerError(raw); err != nil {
+		return &fs.PathError{Op: "data", Path: p, Err: err}
+	}
+	data, d := extractDirectives(srv.withDefaults(raw))
+	if d.status == http.StatusNotFound {
+		return &fs.PathError{Op: "render", Path: p, Err: fs.ErrNotExist}
+	}
+	if content {
+		data, err = srv.withContent(data, p, cl)
+		if err != nil {
+			return err
+		}
+	}
+
+	return srv.execute(w, tp, t, srv.dot(p, data))
+}
+
+// execute renders t, the template at p, to w, notifying the Observer.
+func (srv *TemplateServer) execute(w io.Writer, p string, t *cachedTemplate, data interface{}) error {
+	var funcs template.FuncMap
+	if fb, ok := srv.broker.(FuncDataBroker); ok && t.sets != nil {
+		funcs = fb.Funcs(p)
+	}
+
+	if srv.Observer == nil {
+		return t.executeFuncs(w, funcs, data)
+	}
+
+	start := time.Now()
+	err := t.executeFuncs(w, funcs, data)
+	srv.Observer.OnRender(p, time.Since(start), err)
+	return err
+}
+
+// serveError responds to r with err, using the ErrorHandler if set.
+func (srv *TemplateServer) serveError(w http.ResponseWriter, r *http.Request, err error) {
+	if srv.ErrorHandler != nil {
+		srv.ErrorHandler(w, r, err)
+	} else {
+		internalError(w, r, err)
+	}
+}
+
+// recover recovers from a panic while serving r, such as in a broker, logging
+// it with a stack trace and responding as if execution had failed. As with
+// net/http, http.ErrAbortHandler is not recovered.
+func (srv *TemplateServer) recover(w http.ResponseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+
+	srv.logf("gtemplate: panic serving %s: %v\n%s", r.URL.Path, v, debug.Stack())
+	srv.serveError(w, r, fmt.Errorf("gtemplate: panic serving %s: %v", r.URL.Path, v))
+}
+
+// logf logs through ErrorLog, or the log package's standard logger if nil.
+func (srv *TemplateServer) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Templates returns the sorted paths of all templates found under the document
+// root, being the files with the template extension, whether or not they
+// have been loaded. The filesystem is walked afresh on each call, but no
+// template is parsed. See Cached for the templates currently loaded.
+func (srv *TemplateServer) Templates() []string {
+	var paths []string
+	fs.WalkDir(srv.fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && path.Ext(p) == srv.Extension {
+			paths = append(paths, "/"+p)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+
+	return paths
+}
+
+// Warm loads and caches every template listed by Templates, so that the first
+// requests for each need not wait for it to be parsed, returning an error for
+// each template which fails to parse. Templates which fail are not cached,
+// and are retried when next requested. See Validate to also execute each
+// template.
+func (srv *TemplateServer) Warm() []error {
+	var errs []error
+	for _, p := range srv.Templates() {
+		if _, err := srv.template(p); err != nil {
+			errs = append(errs, &fs.PathError{Op: "load", Path: p, Err: err})
+		}
+	}
+
+	return errs
+}
+
+// Validate parses and executes every template listed by Templates, as a dry
+// run which serves nothing and caches nothing, returning an error for each
+// template which fails. Each template is executed with the data the broker
+// supplies for its path, or an empty map if none, with the "missingkey=error"
+// option so that references to absent keys fail, including optional keys
+// tested by if.
+//
+// Validate catches syntax errors, undefined templates and functions, and
+// fields or keys missing from the sample data, but only along the paths the
+// sample data takes through each template. Branches not taken, and data
+// which differs between requests, such as query parameters, cannot be
+// checked.
+func (srv *TemplateServer) Validate() []error {
+	srv.mut.RLock()
+	base := &includeBase{paths: srv.includes}
+	srv.mut.RUnlock()
+
+	var errs []error
+	for _, p := range srv.Templates() {
+		if err := srv.validate(p, base); err != nil {
+			errs = append(errs, &fs.PathError{Op: "validate", Path: p, Err: err})
+		}
+	}
+
+	return errs
+}
+
+// validate parses the template at p and executes it with missingkey=error.
+func (srv *TemplateServer) validate(p string, base *includeBase) error {
+	t, err := srv.parse(p, strings.TrimPrefix(p, "/"), base)
+	if err != nil {
+		return templateError(p, err)
+	}
+
+	switch r := t.renderer.(type) {
+	case *template.Template:
+		r.Option("missingkey=error")
+	case *texttemplate.Template:
+		r.Option("missingkey=error")
+	}
+
+	data, _ := extractDirectives(srv.withDefaults(srv.pathData(p)))
+	if srv.QueryData {
+		data = withQuery(data, nil)
+	}
+
+	if err := t.Execute(io.Discard, srv.dot(p, data)); err != nil {
+		return templateError(p, err)
+	}
+	return nil
+}
+
+// ServerStats is a snapshot of the template cache statistics of a
+// TemplateServer.
+type ServerStats struct {
+	CachedTemplates int    // templates currently cached
+	Hits            uint64 // requests served from the cache
+	Misses          uint64 // requests which had to load a template
+	Evictions       uint64 // templates evicted from the cache under MaxCached
+}
+
+// serverCounters are the cache statistics counters of a TemplateServer,
+// updated atomically.
+type serverCounters struct {
+	hits, misses, evictions uint64
+	clock                   uint64 // source of recency stamps under MaxCached
+}
+
+// Stats returns the current template cache statistics. Requests for missing
+// templates count as misses.
+func (srv *TemplateServer) Stats() ServerStats {
+	srv.mut.RLock()
+	cached := len(srv.templates)
+	srv.mut.RUnlock()
+
+	return ServerStats{
+		CachedTemplates: cached,
+		Hits:            atomic.LoadUint64(&srv.stats.hits),
+		Misses:          atomic.LoadUint64(&srv.stats.misses),
+		Evictions:       atomic.LoadUint64(&srv.stats.evictions),
+	}
+}
+
+// Cached returns the sorted paths of all templates currently held in the
+// template cache.
+func (srv *TemplateServer) Cached() []string {
+	srv.mut.RLock()
+	defer srv.mut.RUnlock()
+
+	paths := make([]string, 0, len(srv.templates))
+	for p := range srv.templates {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// Reload discards all cached templates and re-reads the include root, so
+// that subsequent requests load each template afresh. If the includes cannot
+// be re-read, the error is returned and the server is left unchanged.
+func (srv *TemplateServer) Reload() error {
+	srv.mut.Lock()
+	defer srv.mut.Unlock()
+
+	if srv.incfs != nil {
+		srv.incstamp = srv.includeStamp()
+		includes := srv.includes
+		srv.includes = nil
+
+		err := srv.walkIncludes(srv.incdir, 0, nil)
+		if err == nil {
+			err = srv.checkIncludes()
+		}
+		if err != nil {
+			srv.includes = includes
+			return err
+		}
+	}
+
+	srv.templates = make(map[string]*cachedTemplate)
+	srv.base = nil
+	return nil
+}
+
+// Close stops any background work of the server and releases its resources,
+// including the template cache. It satisfies io.Closer, allowing a server to
+// be shut down along with the application embedding it. The server must not
+// be used after Close.
+func (srv *TemplateServer) Close() error {
+	srv.mut.Lock()
+	defer srv.mut.Unlock()
+
+	srv.templates = nil
+	srv.base = nil
+	return nil
+}
+
+// newServer returns a TemplateServer serving templates from fsys.
+func newServer(fsys fs.FS, data DataBroker) *TemplateServer {
+	if data == nil {
+		data = DefaultDataBroker
+	}
+
+	return &TemplateServer{
+		broker:    data,
+		templates: make(map[string]*cachedTemplate),
+		fsys:      fsys,
+		Extension: DefaultExtension,
+	}
+}
+
+// NewServer instantiates a new TemplateServer instance which can be
+// used with http.Server as a handler.
+func NewServer(root string, data DataBroker) (*TemplateServer, error) {
+	return NewServerOpts(root, WithBroker(data))
+}
+
+// NewIncludesServer instantiates a new TemplateServer instance with includes
+// support, meaning that templates in includeRoot can be used by any other
+// executing template. Templates in the root still cannot execute each other,
+// unless SharedRoot is set.
+// The instance can be used with http.Server as a handler. Error is returned if
+// root or includeRoot are invalid directories.
+func NewIncludesServer(root string, includeRoot string, data DataBroker) (*TemplateServer, error) {
+	return NewServerOpts(root, WithBroker(data), WithIncludes(includeRoot))
+}
+
+// NewServerFS instantiates a new TemplateServer instance which loads templates
+// from the directory root within fsys, such as an embed.FS, rather than from
+// the operating system's filesystem. Root is a slash-separated path as
+// accepted by fs.FS; use "." for the root of fsys.
+func NewServerFS(fsys fs.FS, root string, data DataBroker) (*TemplateServer, error) {
+	root = path.Clean(root)
+	if !verifyDirectoryFS(fsys, root) {
+		return nil, ErrRootInvalid
+	}
+
+	sub, err := fs.Sub(fsys, root)
+	if err != nil {
+		return nil, ErrRootInvalid
+	}
+
+	return newServer(sub, data), nil
+}
+
+// NewIncludesServerFS is like NewServerFS, but with includes support as
+// described by NewIncludesServer. Both root and includeRoot are directories
+// within fsys.
+func NewIncludesServerFS(fsys fs.FS, root string, includeRoot string, data DataBroker) (*TemplateServer, error) {
+	srv, err := NewServerFS(fsys, root, data)
+	if err != nil {
+		return nil, err
 	}
 
-	err := srv.loadIncludes(includeRoot)
+	err = srv.loadIncludesFS(fsys, path.Clean(includeRoot))
 	if err != nil {
 		return nil, err
 	}
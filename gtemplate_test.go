@@ -3,11 +3,30 @@
 package gtemplate
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"testing"
+	"testing/fstest"
 )
 
 const (
@@ -16,6 +35,9 @@ const (
 	TestIncludesRoot = "testing/templates/"
 )
 
+//go:embed testing/public testing/templates
+var TestFS embed.FS
+
 type TestBroker struct{}
 
 func (broker TestBroker) Data(path string) map[string]interface{} {
@@ -26,6 +48,13 @@ func (broker TestBroker) Data(path string) map[string]interface{} {
 	}
 }
 
+// StaticBroker supplies the same data for every path.
+type StaticBroker map[string]interface{}
+
+func (broker StaticBroker) Data(path string) map[string]interface{} {
+	return broker
+}
+
 func killServer(srv *http.Server) {
 	time.Sleep(10 * time.Second)
 	srv.Shutdown(context.Background())
@@ -115,3 +144,2454 @@ func TestTemplateServer(t *testing.T) {
 	}
 	t.Log("Server gracefully terminating")
 }
+
+func TestNotFoundTemplate(t *testing.T) {
+	srv, err := NewServer(TestDocumentRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		notFound string
+		ctype    string
+		body     string
+	}{
+		{"", "text/plain; charset=utf-8", "404 not found"},
+		{"404.gohtml", "text/html; charset=utf-8", "Nothing to see here, Ethan Marshall"},
+		{"notexist.gohtml", "text/plain; charset=utf-8", "404 not found"},
+	}
+
+	for _, elem := range tests {
+		srv.NotFoundTemplate = elem.notFound
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/missing.gohtml", nil))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("not found %q: got status %d, expected %d", elem.notFound, w.Code, http.StatusNotFound)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != elem.ctype {
+			t.Errorf("not found %q: got content type %q, expected %q", elem.notFound, ct, elem.ctype)
+		}
+		if !strings.Contains(w.Body.String(), elem.body) {
+			t.Errorf("not found %q: body %q does not contain %q", elem.notFound, w.Body.String(), elem.body)
+		}
+	}
+
+	// A template failing to execute is not sent in part
+	fsys := fstest.MapFS{
+		"site/404.gohtml": {Data: []byte("partial {{call .nothing}}")},
+	}
+	srv, err = NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.NotFoundTemplate = "404.gohtml"
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/missing.gohtml", nil))
+	if w.Code != http.StatusNotFound || w.Body.String() != "404 not found\n" {
+		t.Errorf("not found failing: got %d %q, expected %d %q", w.Code, w.Body.String(), http.StatusNotFound, "404 not found\n")
+	}
+}
+
+func TestTextPaths(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/robots.txt", map[string]interface{}{
+		"contact": "Webmaster <webmaster@example.com>",
+	})
+
+	srv, err := NewServer(TestDocumentRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.TextPaths = []string{"/robots.txt", "/.well-known/security.txt"}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/robots.txt", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("robots.txt: got status %d, expected %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("robots.txt: got content type %q, expected text/plain", ct)
+	}
+	if !strings.Contains(w.Body.String(), "# Contact: Webmaster <webmaster@example.com>") {
+		t.Errorf("robots.txt: body %q missing unescaped contact", w.Body.String())
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	srv, err := NewServer(TestDocumentRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/broken.gohtml", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("default handler: got status %d, expected %d", w.Code, http.StatusInternalServerError)
+	}
+	if !strings.HasPrefix(w.Body.String(), "500 internal error") {
+		t.Errorf("default handler: unexpected body %q", w.Body.String())
+	}
+
+	var handled error
+	srv.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("something went wrong"))
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/broken.gohtml", nil))
+	if handled == nil {
+		t.Fatal("custom handler: handler not called")
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "something went wrong" {
+		t.Errorf("custom handler: got %d %q, expected handler response", w.Code, w.Body.String())
+	}
+}
+
+func TestLoadIncludesLimits(t *testing.T) {
+	const depth = 4
+
+	deep := t.TempDir()
+	dir := deep
+	for i := 0; i <= depth+1; i++ {
+		dir = filepath.Join(dir, "sub")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	loop := t.TempDir()
+	if err := os.Mkdir(filepath.Join(loop, "a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(loop, filepath.Join(loop, "a", "loop")); err != nil {
+		t.Skipf("symlinks unsupported: %s", err)
+	}
+
+	dirs := []struct {
+		path string
+		err  error
+	}{
+		{TestIncludesRoot, nil},
+		{deep, ErrIncludesDepth},
+		{loop, ErrIncludesLoop},
+	}
+
+	for _, elem := range dirs {
+		srv := &TemplateServer{MaxIncludeDepth: depth}
+		err := srv.loadIncludes(elem.path)
+		if err != elem.err {
+			t.Errorf("loadIncludes %q: got error %v, expected %v", elem.path, err, elem.err)
+		}
+	}
+
+	if _, err := NewServerOpts(TestDocumentRoot, WithIncludes(deep)); err != nil {
+		t.Errorf("default include depth: got error %v, expected none", err)
+	}
+	if _, err := NewServerOpts(TestDocumentRoot, WithIncludes(deep), WithMaxIncludeDepth(depth)); err != ErrIncludesDepth {
+		t.Errorf("include depth option: got error %v, expected %v", err, ErrIncludesDepth)
+	}
+}
+
+func TestBufferedOutput(t *testing.T) {
+	srv, err := NewServer(TestDocumentRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		unbuffered bool
+		partial    bool
+	}{
+		{false, false},
+		{true, true},
+	}
+
+	for _, elem := range tests {
+		srv.Unbuffered = elem.unbuffered
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/partial.gohtml", nil))
+
+		partial := strings.Contains(w.Body.String(), "Rendered before failure")
+		if partial != elem.partial {
+			t.Errorf("unbuffered %v: got partial output %v, expected %v", elem.unbuffered, partial, elem.partial)
+		}
+		if !elem.unbuffered && w.Code != http.StatusInternalServerError {
+			t.Errorf("unbuffered %v: got status %d, expected %d", elem.unbuffered, w.Code, http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "public")
+	outside := filepath.Join(dir, "outside.gohtml")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outside, []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link.gohtml")); err != nil {
+		t.Skipf("symlinks unsupported: %s", err)
+	}
+
+	tests := []struct {
+		follow bool
+		status int
+	}{
+		{false, http.StatusNotFound},
+		{true, http.StatusOK},
+	}
+
+	for _, elem := range tests {
+		srv, err := NewServer(root, TestBroker{})
+		if err != nil {
+			t.Fatalf("Server init failed: %s", err.Error())
+		}
+		srv.FollowSymlinks = elem.follow
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/link.gohtml", nil))
+		if w.Code != elem.status {
+			t.Errorf("follow %v: got status %d, expected %d", elem.follow, w.Code, elem.status)
+		}
+	}
+
+	srv := new(TemplateServer)
+	if err := srv.loadIncludes(root); err != nil {
+		t.Fatalf("loadIncludes: unexpected error %s", err)
+	}
+	if len(srv.includes) != 0 {
+		t.Errorf("loadIncludes: got includes %q, expected outside link to be skipped", srv.includes)
+	}
+}
+
+func TestServerFS(t *testing.T) {
+	if _, err := NewServerFS(TestFS, "testing/notexist", TestBroker{}); err != ErrRootInvalid {
+		t.Errorf("NewServerFS invalid root: got error %v, expected %v", err, ErrRootInvalid)
+	}
+
+	srv, err := NewIncludesServerFS(TestFS, "testing/public/", "testing/templates", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	paths := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "<title>My Page</title>"},
+		{"/temp.gohtml", http.StatusOK, "<h1>My Page</h1>"},
+		{"/notexist.gohtml", http.StatusNotFound, "404 not found"},
+	}
+
+	for _, elem := range paths {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.status {
+			t.Errorf("serve %q: got status %d, expected %d", elem.path, w.Code, elem.status)
+		}
+		if !strings.Contains(w.Body.String(), elem.body) {
+			t.Errorf("serve %q: body %q does not contain %q", elem.path, w.Body.String(), elem.body)
+		}
+	}
+}
+
+type TestRequestBroker struct {
+	TestBroker
+}
+
+func (broker TestRequestBroker) DataForRequest(r *http.Request) map[string]interface{} {
+	return map[string]interface{}{
+		"title":  "Page in " + r.URL.Query().Get("lang"),
+		"author": r.URL.Path,
+	}
+}
+
+func TestRequestDataBroker(t *testing.T) {
+	srv, err := NewServer(TestDocumentRoot, TestRequestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	r := httptest.NewRequest("GET", "/?lang=fr", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	if !strings.Contains(w.Body.String(), "<title>Page in fr</title>") {
+		t.Errorf("request broker: body %q missing query dependent title", w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "Written by /index.gohtml") {
+		t.Errorf("request broker: body %q missing template path", w.Body.String())
+	}
+}
+
+type TestContextBroker struct {
+	TestBroker
+	cancelled bool
+}
+
+func (broker *TestContextBroker) DataCtx(ctx context.Context, path string) map[string]interface{} {
+	broker.cancelled = ctx.Err() != nil
+	return broker.Data(path)
+}
+
+func TestContextDataBroker(t *testing.T) {
+	broker := new(TestContextBroker)
+	srv, err := NewServer(TestDocumentRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	srv.ServeHTTP(httptest.NewRecorder(), r)
+	if !broker.cancelled {
+		t.Error("context broker: request context not passed to DataCtx")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	fsys := fstest.MapFS{
+		"page.gohtml":   {Data: []byte("<p>{{.title}}</p>")},
+		"feed.xml":      {Data: []byte("<rss>{{.title}}</rss>")},
+		"image.svg":     {Data: []byte("<svg></svg>")},
+		"data.custom":   {Data: []byte("{{.title}}")},
+		"notes.unknown": {Data: []byte("{{.title}}")},
+	}
+
+	srv, err := NewServerFS(fsys, ".", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.ContentTypes = map[string]string{
+		".custom": "application/x-custom",
+		".xml":    "application/rss+xml",
+	}
+
+	paths := []struct {
+		path  string
+		ctype string
+	}{
+		{"/page.gohtml", "text/html; charset=utf-8"},
+		{"/feed.xml", "application/rss+xml"},
+		{"/image.svg", "image/svg+xml; charset=utf-8"},
+		{"/data.custom", "application/x-custom"},
+		{"/notes.unknown", "text/plain; charset=utf-8"},
+	}
+
+	for _, elem := range paths {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if ct := w.Header().Get("Content-Type"); ct != elem.ctype {
+			t.Errorf("content type %q: got %q, expected %q", elem.path, ct, elem.ctype)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	srv, err := NewServer(TestDocumentRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.Compression = true
+
+	tests := []struct {
+		accept     string
+		minSize    int
+		unbuffered bool
+		gzipped    bool
+	}{
+		{"", 0, false, false},
+		{"gzip", 0, false, true},
+		{"deflate, gzip;q=0.5", 0, false, true},
+		{"gzip;q=0", 0, false, false},
+		{"*", 0, false, true},
+		{"*;q=1, gzip;q=0", 0, false, false},
+		{"gzip;q=0, *", 0, false, false},
+		{"*;q=0, gzip", 0, false, true},
+		{"gzip", 1 << 20, false, false},
+		{"gzip", 1 << 20, true, true},
+	}
+
+	for _, elem := range tests {
+		srv.CompressionMinSize = elem.minSize
+		srv.Unbuffered = elem.unbuffered
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", elem.accept)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+
+		gzipped := w.Header().Get("Content-Encoding") == "gzip"
+		if gzipped != elem.gzipped {
+			t.Errorf("compression %q (min %d): got gzipped %v, expected %v", elem.accept, elem.minSize, gzipped, elem.gzipped)
+			continue
+		}
+
+		var body io.Reader = w.Body
+		if gzipped {
+			if w.Header().Get("Content-Length") != "" {
+				t.Errorf("compression %q: content length set on gzipped response", elem.accept)
+			}
+
+			body, err = gzip.NewReader(w.Body)
+			if err != nil {
+				t.Errorf("compression %q: invalid gzip stream: %s", elem.accept, err)
+				continue
+			}
+		}
+
+		buf, err := io.ReadAll(body)
+		if err != nil || !strings.Contains(string(buf), "<title>My Page</title>") {
+			t.Errorf("compression %q: got body %q (%v), expected rendered page", elem.accept, buf, err)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	srv, err := NewServer(TestDocumentRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.ETag = true
+	srv.AnyMethod = true
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/404.gohtml", nil))
+	tag := w.Header().Get("ETag")
+	if tag == "" {
+		t.Fatal("etag: no ETag header sent")
+	}
+
+	tests := []struct {
+		method string
+		match  string
+		status int
+	}{
+		{"GET", "", http.StatusOK},
+		{"GET", tag, http.StatusNotModified},
+		{"HEAD", tag, http.StatusNotModified},
+		{"GET", `"other", W/` + tag, http.StatusNotModified},
+		{"GET", "*", http.StatusNotModified},
+		{"GET", `"other"`, http.StatusOK},
+		{"POST", tag, http.StatusOK},
+	}
+
+	for _, elem := range tests {
+		r := httptest.NewRequest(elem.method, "/404.gohtml", nil)
+		r.Header.Set("If-None-Match", elem.match)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+
+		if w.Code != elem.status {
+			t.Errorf("etag %s %q: got status %d, expected %d", elem.method, elem.match, w.Code, elem.status)
+		}
+		if elem.status == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("etag %s %q: body sent with 304 response", elem.method, elem.match)
+		}
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	mtime := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"site/page.gohtml": {Data: []byte("{{.title}}"), ModTime: mtime},
+		"site/data.gohtml": {Data: []byte("{{.title}}"), ModTime: mtime},
+	}
+
+	broker := NewBroker()
+	broker.HandleData("/page.gohtml", map[string]interface{}{"title": "Page"})
+	broker.HandleData("/data.gohtml", map[string]interface{}{"title": "Data", ModTimeKey: "2022-06-02T12:00:00Z"})
+
+	srv, err := NewServerFS(fsys, "site", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.LastModified = true
+
+	at := func(t time.Time) string { return t.Format(http.TimeFormat) }
+	tests := []struct {
+		path  string
+		since string
+		match string
+		code  int
+		last  string
+	}{
+		{"/page.gohtml", "", "", http.StatusOK, at(mtime)},
+		{"/page.gohtml", at(mtime), "", http.StatusNotModified, at(mtime)},
+		{"/page.gohtml", at(mtime.Add(time.Hour)), "", http.StatusNotModified, at(mtime)},
+		{"/page.gohtml", at(mtime.Add(-time.Hour)), "", http.StatusOK, at(mtime)},
+		{"/page.gohtml", at(mtime), `"other"`, http.StatusOK, at(mtime)},
+		{"/page.gohtml", "garbage", "", http.StatusOK, at(mtime)},
+		{"/data.gohtml", at(mtime), "", http.StatusOK, at(mtime.Add(24 * time.Hour))},
+		{"/data.gohtml", at(mtime.Add(24 * time.Hour)), "", http.StatusNotModified, at(mtime.Add(24 * time.Hour))},
+	}
+	for _, elem := range tests {
+		r := httptest.NewRequest("GET", elem.path, nil)
+		r.Header.Set("If-Modified-Since", elem.since)
+		if elem.match != "" {
+			r.Header.Set("If-None-Match", elem.match)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+
+		if w.Code != elem.code || w.Header().Get("Last-Modified") != elem.last {
+			t.Errorf("last modified %q (since %q): got %d %q, expected %d %q",
+				elem.path, elem.since, w.Code, w.Header().Get("Last-Modified"), elem.code, elem.last)
+		}
+		if elem.code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("last modified %q (since %q): body sent with 304 response", elem.path, elem.since)
+		}
+		if elem.code == http.StatusOK && strings.Contains(w.Body.String(), ModTimeKey) {
+			t.Errorf("last modified %q: reserved key given to template", elem.path)
+		}
+	}
+
+	srv.LastModified = false
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/page.gohtml", nil))
+	if lm := w.Header().Get("Last-Modified"); lm != "" {
+		t.Errorf("last modified disabled: got header %q, expected none", lm)
+	}
+}
+
+func TestRootTemplate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/home.gohtml":       {Data: []byte("home {{.title}}")},
+		"site/index.gohtml":      {Data: []byte("index {{.title}}")},
+		"site/blog/index.gohtml": {Data: []byte("blog {{.title}}")},
+	}
+
+	broker := NewBroker()
+	broker.HandleData("/home.gohtml", map[string]interface{}{"title": "Welcome"})
+	broker.HandleData("/blog/", map[string]interface{}{"title": "Posts"})
+
+	srv, err := NewServerFS(fsys, "site", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.RootTemplate = "home.gohtml"
+
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/", "home Welcome"},
+		{"/home.gohtml", "home Welcome"},
+		{"/index.gohtml", "index "},
+		{"/blog/", "blog Posts"},
+	}
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != elem.body {
+			t.Errorf("root template %q: got %d %q, expected 200 %q", elem.path, w.Code, w.Body.String(), elem.body)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := srv.Render(&buf, "/"); err != nil || buf.String() != "home Welcome" {
+		t.Errorf("root template render: got %q (%v), expected \"home Welcome\"", buf.String(), err)
+	}
+
+	srv.RootTemplate = "missing.gohtml"
+	if srv.Has("/") {
+		t.Errorf("root template missing: Has reported root, expected missing")
+	}
+}
+
+func TestLayout(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout.gohtml":     {Data: []byte(`<html>{{block "content" .}}default{{end}}</html>`)},
+		"page.gohtml":       {Data: []byte(`{{define "content"}}<p>{{.title}}</p>{{end}}`)},
+		"standalone.gohtml": {Data: []byte(`<p>standalone {{.title}}</p>`)},
+	}
+
+	srv, err := NewServerFS(fsys, ".", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.Layout = "layout.gohtml"
+
+	paths := []struct {
+		path string
+		body string
+	}{
+		{"/page.gohtml", "<html><p>My Page</p></html>"},
+		{"/standalone.gohtml", "<p>standalone My Page</p>"},
+		{"/layout.gohtml", "<html>default</html>"},
+	}
+
+	for _, elem := range paths {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Body.String() != elem.body {
+			t.Errorf("layout %q: got body %q, expected %q", elem.path, w.Body.String(), elem.body)
+		}
+	}
+}
+
+func TestExtension(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.tmpl": {Data: []byte(`<p>{{.title}}</p>`)},
+	}
+
+	broker := &Broker{Extension: ".tmpl"}
+	broker.HandleData("/", map[string]interface{}{
+		"title": "Custom extension",
+	})
+
+	srv, err := NewServerFS(fsys, ".", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.Extension = ".tmpl"
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Body.String() != "<p>Custom extension</p>" {
+		t.Errorf("extension: got body %q, expected index.tmpl with broker data", w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("extension: got content type %q, expected text/html", ct)
+	}
+}
+
+func TestConcurrentLoad(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, TestBroker{})
+		if err != nil {
+			t.Fatalf("Server init failed: %s", err.Error())
+		}
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		codes := make([]int, 32)
+		for j := range codes {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				<-start
+
+				w := httptest.NewRecorder()
+				srv.ServeHTTP(w, httptest.NewRequest("GET", "/index.gohtml", nil))
+				codes[j] = w.Code
+			}(j)
+		}
+		close(start)
+		wg.Wait()
+
+		for j, code := range codes {
+			if code != http.StatusOK {
+				t.Fatalf("run %d, request %d: got status %d, expected %d", i, j, code, http.StatusOK)
+			}
+		}
+		if cached := srv.Cached(); len(cached) != 1 {
+			t.Errorf("run %d: got cached %q, expected exactly one template", i, cached)
+		}
+	}
+}
+
+func TestRequestUnmodified(t *testing.T) {
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []string{"/", "/./temp.gohtml", "//index.gohtml"}
+	for _, elem := range tests {
+		r := httptest.NewRequest("GET", elem, nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("request %q: got status %d, expected %d", elem, w.Code, http.StatusOK)
+		}
+		if r.URL.Path != elem {
+			t.Errorf("request %q: path modified to %q", elem, r.URL.Path)
+		}
+	}
+}
+
+func TestCleanURLs(t *testing.T) {
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, TestRequestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		path   string
+		code   int
+		substr string
+	}{
+		{"/temp", http.StatusOK, "Written by /temp.gohtml"},
+		{"/blog/post", http.StatusOK, "Blog post by /blog/post.gohtml"},
+		{"/blog/post.gohtml", http.StatusOK, "Blog post by /blog/post.gohtml"},
+		{"/blog/", http.StatusOK, "Blog index"},
+		{"/blog/missing", http.StatusNotFound, ""},
+		{"/robots", http.StatusNotFound, ""},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.code {
+			t.Errorf("clean url %q: got status %d, expected %d", elem.path, w.Code, elem.code)
+		}
+		if !strings.Contains(w.Body.String(), elem.substr) {
+			t.Errorf("clean url %q: body %q missing %q", elem.path, w.Body.String(), elem.substr)
+		}
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	missing := map[string]interface{}{
+		StatusKey: 404,
+		"author":  "the broker",
+	}
+	broker := NewBroker()
+	broker.HandleData("/temp.gohtml", missing)
+	broker.HandleData("/blog/post.gohtml", map[string]interface{}{
+		StatusKey: 410.0,
+		"author":  "a former author",
+	})
+	broker.HandleData("/broken.gohtml", map[string]interface{}{
+		RedirectKey: "/temp.gohtml",
+	})
+	broker.HandleData("/partial.gohtml", map[string]interface{}{
+		StatusKey:   http.StatusMovedPermanently,
+		RedirectKey: "/blog/post.gohtml",
+	})
+
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.NotFoundTemplate = "/404.gohtml"
+
+	tests := []struct {
+		path     string
+		code     int
+		location string
+		substr   string
+	}{
+		{"/temp.gohtml", http.StatusNotFound, "", "Nothing to see here, the broker"},
+		{"/blog/post.gohtml", http.StatusGone, "", "Blog post by a former author"},
+		{"/broken.gohtml", http.StatusFound, "/temp.gohtml", ""},
+		{"/partial.gohtml", http.StatusMovedPermanently, "/blog/post.gohtml", ""},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.code {
+			t.Errorf("reserved %q: got status %d, expected %d", elem.path, w.Code, elem.code)
+		}
+		if loc := w.Header().Get("Location"); loc != elem.location {
+			t.Errorf("reserved %q: got location %q, expected %q", elem.path, loc, elem.location)
+		}
+		if !strings.Contains(w.Body.String(), elem.substr) {
+			t.Errorf("reserved %q: body %q missing %q", elem.path, w.Body.String(), elem.substr)
+		}
+	}
+
+	if _, ok := missing[StatusKey]; !ok {
+		t.Errorf("reserved: broker data was modified")
+	}
+}
+
+func TestHeadersKey(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/temp.gohtml", map[string]interface{}{
+		HeadersKey: map[string]string{
+			"Cache-Control": "max-age=60",
+			"Content-Type":  "application/xhtml+xml",
+		},
+	})
+	broker.HandleData("/blog/post.gohtml", map[string]interface{}{
+		HeadersKey: map[string]interface{}{
+			"X-Robots-Tag": "noindex",
+		},
+	})
+	broker.HandleData("/broken.gohtml", map[string]interface{}{
+		RedirectKey: "/temp.gohtml",
+		HeadersKey:  http.Header{"Cache-Control": {"no-store"}},
+	})
+
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		path   string
+		header string
+		value  string
+	}{
+		{"/temp.gohtml", "Cache-Control", "max-age=60"},
+		{"/temp.gohtml", "Content-Type", "application/xhtml+xml"},
+		{"/blog/post.gohtml", "X-Robots-Tag", "noindex"},
+		{"/blog/post.gohtml", "Content-Type", "text/html; charset=utf-8"},
+		{"/broken.gohtml", "Cache-Control", "no-store"},
+		{"/broken.gohtml", "Location", "/temp.gohtml"},
+	}
+
+	for _, elem := range tests {
+		for _, unbuffered := range []bool{false, true} {
+			srv.Unbuffered = unbuffered
+
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+			if got := w.Header().Get(elem.header); got != elem.value {
+				t.Errorf("headers %q (unbuffered %v): got %s %q, expected %q", elem.path, unbuffered, elem.header, got, elem.value)
+			}
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	for _, elem := range []string{"/", "/", "/temp", "/temp", "/temp.gohtml", "/missing.gohtml"} {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", elem, nil))
+	}
+
+	expected := ServerStats{CachedTemplates: 2, Hits: 3, Misses: 3}
+	if got := srv.Stats(); got != expected {
+		t.Errorf("stats: got %+v, expected %+v", got, expected)
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/", map[string]interface{}{
+		"title":  "My Page",
+		"author": "Ethan Marshall",
+	})
+
+	tests := []struct {
+		mode string
+		code int
+	}{
+		{"", http.StatusOK},
+		{"zero", http.StatusOK},
+		{"error", http.StatusInternalServerError},
+	}
+
+	for _, elem := range tests {
+		srv, err := NewServerOpts(TestDocumentRoot,
+			WithBroker(broker),
+			WithIncludes(TestIncludesRoot),
+			WithMissingKey(elem.mode),
+		)
+		if err != nil {
+			t.Fatalf("Server init failed: %s", err.Error())
+		}
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/temp.gohtml", nil))
+		if w.Code != elem.code {
+			t.Errorf("missingkey %q: got status %d, expected %d", elem.mode, w.Code, elem.code)
+		}
+	}
+
+	srv, err := NewServer(TestDocumentRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.MissingKey = "bogus"
+	if _, err := srv.template("/index.gohtml"); err != ErrMissingKey {
+		t.Errorf("missingkey bogus: got error %v, expected %v", err, ErrMissingKey)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleFunc("/temp.gohtml", func(path string) (map[string]interface{}, error) {
+		panic("broker exploded")
+	})
+
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	var logged strings.Builder
+	srv.ErrorLog = log.New(&logged, "", 0)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/temp.gohtml", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("recover: got status %d, expected %d", w.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(logged.String(), "/temp.gohtml: broker exploded") || !strings.Contains(logged.String(), "goroutine") {
+		t.Errorf("recover: log %q missing path, panic value or stack", logged.String())
+	}
+
+	var handled error
+	srv.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/temp.gohtml", nil))
+
+	if w.Code != http.StatusServiceUnavailable || handled == nil {
+		t.Errorf("recover: panic not passed to error handler")
+	}
+}
+
+// BenchmarkLoadTemplates measures loading every page of a site, the pages
+// sharing a common set of includes.
+func BenchmarkLoadTemplates(b *testing.B) {
+	const pages, includes = 50, 20
+
+	root, incroot := b.TempDir(), b.TempDir()
+	for i := 0; i < includes; i++ {
+		def := fmt.Sprintf(`{{define "partial%d"}}<p>Partial {{.title}}</p>{{end}}`, i)
+		if err := os.WriteFile(filepath.Join(incroot, fmt.Sprintf("partial%d.gohtml", i)), []byte(def), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 0; i < pages; i++ {
+		page := fmt.Sprintf(`<h1>Page %d</h1>{{template "partial%d" .}}`, i, i%includes)
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("page%d.gohtml", i)), []byte(page), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	srv, err := NewIncludesServer(root, incroot, TestBroker{})
+	if err != nil {
+		b.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		srv.Reload()
+		for j := 0; j < pages; j++ {
+			if _, err := srv.template(fmt.Sprintf("/page%d.gohtml", j)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkLoadTemplate compares strategies for loading a page alongside the
+// includes: parsing the includes afresh for each page, parsing the page onto
+// a clone of the includes parsed once (as the server does), and parsing the
+// pages into a single shared set. The shared set is replaced after each run
+// of pages pages, so that it stays the size of a site rather than growing
+// with b.N.
+func BenchmarkLoadTemplate(b *testing.B) {
+	const pages, includes = 50, 20
+
+	sources := make([]string, includes)
+	for i := range sources {
+		sources[i] = fmt.Sprintf(`{{define "partial%d"}}<p>Partial {{.title}} {{range .items}}<li>{{.}}</li>{{end}}</p>{{end}}`, i)
+	}
+	page := func(i int) string {
+		return fmt.Sprintf(`<h1>Page %d</h1>{{template "partial%d" .}}`, i, i%includes)
+	}
+	parseIncludes := func(t *template.Template) {
+		for i, elem := range sources {
+			template.Must(t.New(fmt.Sprintf("partial%d.gohtml", i)).Parse(elem))
+		}
+	}
+
+	b.Run("parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			t := template.New(baseName)
+			parseIncludes(t)
+			template.Must(t.New("page.gohtml").Parse(page(i)))
+		}
+	})
+	b.Run("clone", func(b *testing.B) {
+		base := template.New(baseName)
+		parseIncludes(base)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			t := template.Must(base.Clone())
+			template.Must(t.New("page.gohtml").Parse(page(i)))
+		}
+	})
+	b.Run("shared", func(b *testing.B) {
+		var shared *template.Template
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if i%pages == 0 {
+				b.StopTimer()
+				shared = template.New(baseName)
+				parseIncludes(shared)
+				b.StartTimer()
+			}
+			template.Must(shared.New(fmt.Sprintf("page%d.gohtml", i%pages)).Parse(page(i)))
+		}
+	})
+}
+
+func TestRender(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/", map[string]interface{}{
+		"title":  "Rendered offline",
+		"author": "Ethan Marshall",
+	})
+	broker.HandleData("/blog/post.gohtml", map[string]interface{}{
+		StatusKey: 404,
+	})
+
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		path     string
+		substr   string
+		notExist bool
+	}{
+		{"/temp", "<title>Rendered offline</title>", false},
+		{"temp.gohtml", "<title>Rendered offline</title>", false},
+		{"/blog/", "Blog index", false},
+		{"/blog/post.gohtml", "", true},
+		{"/missing.gohtml", "", true},
+	}
+
+	for _, elem := range tests {
+		var buf bytes.Buffer
+		err := srv.Render(&buf, elem.path)
+
+		if errors.Is(err, fs.ErrNotExist) != elem.notExist {
+			t.Errorf("render %q: got error %v, expected not exist %v", elem.path, err, elem.notExist)
+		}
+		if !strings.Contains(buf.String(), elem.substr) {
+			t.Errorf("render %q: output %q missing %q", elem.path, buf.String(), elem.substr)
+		}
+	}
+}
+
+func TestHeadOptions(t *testing.T) {
+	// Fixed, so that the content length is the same for each request
+	broker := StaticBroker{
+		"title":  "My Page",
+		"author": "Ethan Marshall",
+		"date":   time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.Compression = true
+
+	get := httptest.NewRecorder()
+	srv.ServeHTTP(get, httptest.NewRequest("GET", "/temp.gohtml", nil))
+
+	for _, unbuffered := range []bool{false, true} {
+		srv.Unbuffered = unbuffered
+
+		for _, gz := range []bool{false, true} {
+			r := httptest.NewRequest("HEAD", "/temp.gohtml", nil)
+			if gz {
+				r.Header.Set("Accept-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK || w.Body.Len() != 0 {
+				t.Errorf("head (unbuffered %v, gzip %v): got %d with %d byte body, expected 200 and none", unbuffered, gz, w.Code, w.Body.Len())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != get.Header().Get("Content-Type") {
+				t.Errorf("head (unbuffered %v, gzip %v): got content type %q, expected %q", unbuffered, gz, ct, get.Header().Get("Content-Type"))
+			}
+			if gz != (w.Header().Get("Content-Encoding") == "gzip") {
+				t.Errorf("head (unbuffered %v, gzip %v): got content encoding %q", unbuffered, gz, w.Header().Get("Content-Encoding"))
+			}
+		}
+	}
+
+	srv.Unbuffered = false
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("HEAD", "/temp.gohtml", nil))
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(get.Body.Len()) {
+		t.Errorf("head: got content length %q, expected %d", cl, get.Body.Len())
+	}
+
+	tests := []struct {
+		path  string
+		code  int
+		allow string
+	}{
+		{"/temp.gohtml", http.StatusNoContent, "GET, HEAD, OPTIONS"},
+		{"/missing.gohtml", http.StatusNotFound, ""},
+	}
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("OPTIONS", elem.path, nil))
+
+		if w.Code != elem.code || w.Header().Get("Allow") != elem.allow {
+			t.Errorf("options %q: got %d allowing %q, expected %d allowing %q", elem.path, w.Code, w.Header().Get("Allow"), elem.code, elem.allow)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		method string
+		any    bool
+		code   int
+	}{
+		{"GET", false, http.StatusOK},
+		{"POST", false, http.StatusMethodNotAllowed},
+		{"DELETE", false, http.StatusMethodNotAllowed},
+		{"POST", true, http.StatusOK},
+	}
+
+	for _, elem := range tests {
+		srv.AnyMethod = elem.any
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(elem.method, "/temp.gohtml", nil))
+		if w.Code != elem.code {
+			t.Errorf("method %s (any %v): got status %d, expected %d", elem.method, elem.any, w.Code, elem.code)
+		}
+		if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+			t.Errorf("method %s (any %v): got allow %q", elem.method, elem.any, w.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestQueryData(t *testing.T) {
+	broker := NewBroker()
+	broker.HandleData("/", map[string]interface{}{
+		"title": "Query",
+	})
+	broker.HandleData("/blog/", map[string]interface{}{
+		QueryKey: map[string]string{"page": "broker"},
+	})
+
+	srv, err := NewServer(TestDocumentRoot, broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		enabled bool
+		path    string
+		substr  string
+	}{
+		{false, "/query.gohtml?page=2", "<p>Page  of </p>"},
+		{true, "/query.gohtml?page=2&tag=go&tag=web", "<p>Page 2 of go</p>"},
+		{true, "/query.gohtml", "<p>Page  of </p>"},
+	}
+
+	for _, elem := range tests {
+		srv.QueryData = elem.enabled
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+		if !strings.Contains(w.Body.String(), elem.substr) {
+			t.Errorf("query %q (enabled %v): body %q missing %q", elem.path, elem.enabled, w.Body.String(), elem.substr)
+		}
+	}
+
+	if dat := withQuery(broker.Data("/blog/post.gohtml"), url.Values{"page": {"2"}}); dat[QueryKey].(map[string]string)["page"] != "broker" {
+		t.Errorf("query: broker data overridden by query parameters")
+	}
+}
+
+func TestClose(t *testing.T) {
+	srv, err := NewIncludesServer(TestDocumentRoot, TestIncludesRoot, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	var c io.Closer = srv
+	if err := c.Close(); err != nil {
+		t.Errorf("close: got error %v", err)
+	}
+	if cached := srv.Cached(); len(cached) != 0 {
+		t.Errorf("close: got cached %q, expected cache released", cached)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":      {Data: []byte("index")},
+		"site/about.gohtml":      {Data: []byte("about")},
+		"site/blog/post.gohtml":  {Data: []byte("post")},
+		"site/blog/notes.md":     {Data: []byte("notes")},
+		"site/robots.txt":        {Data: []byte("robots")},
+		"site/style/main.gohtml": {Data: []byte("{{ broken")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	expected := []string{"/about.gohtml", "/blog/post.gohtml", "/index.gohtml", "/style/main.gohtml"}
+	if got := srv.Templates(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("templates: got %q, expected %q", got, expected)
+	}
+	if cached := srv.Cached(); len(cached) != 0 {
+		t.Errorf("templates: got cached %q, expected nothing parsed", cached)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":   {Data: []byte("{{.title}} by {{.author}}")},
+		"site/broken.gohtml":  {Data: []byte("{{ broken")},
+		"site/missing.gohtml": {Data: []byte("{{.title}}: {{.summary}}")},
+		"site/undef.gohtml":   {Data: []byte(`{{template "footer"}}`)},
+		"site/field.gohtml":   {Data: []byte("{{.date.Nonexistent}}")},
+		"site/branch.gohtml":  {Data: []byte("{{if .title}}{{.title}}{{else}}{{.summary}}{{end}}")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	var failed []string
+	for _, err := range srv.Validate() {
+		var perr *fs.PathError
+		if !errors.As(err, &perr) || perr.Op != "validate" {
+			t.Errorf("validate: got error %v, expected *fs.PathError", err)
+			continue
+		}
+		failed = append(failed, perr.Path)
+	}
+
+	expected := []string{"/broken.gohtml", "/field.gohtml", "/missing.gohtml", "/undef.gohtml"}
+	if !reflect.DeepEqual(failed, expected) {
+		t.Errorf("validate: got failures %q, expected %q", failed, expected)
+	}
+	if cached := srv.Cached(); len(cached) != 0 {
+		t.Errorf("validate: got cached %q, expected nothing cached", cached)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":     {Data: []byte("{{.title}}")},
+		"site/blog/post.gohtml": {Data: []byte("{{.summary}}")},
+		"site/broken.gohtml":    {Data: []byte("{{ broken")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	errs := srv.Warm()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "/broken.gohtml") {
+		t.Errorf("warm: got errors %v, expected only /broken.gohtml", errs)
+	}
+
+	expected := []string{"/blog/post.gohtml", "/index.gohtml"}
+	if cached := srv.Cached(); !reflect.DeepEqual(cached, expected) {
+		t.Errorf("warm: got cached %q, expected %q", cached, expected)
+	}
+}
+
+func TestTemplateError(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":   {Data: []byte("{{.title}}\n\n{{ broken")},
+		"site/exec.gohtml":    {Data: []byte("{{.title}}\n{{.title.Missing}}")},
+		"site/include.gohtml": {Data: []byte(`{{template "partial.gohtml" .}}`)},
+		"inc/partial.gohtml":  {Data: []byte("{{.title}}\n\n\n{{.title.Missing}}")},
+	}
+
+	srv, err := NewIncludesServerFS(fsys, "site", "inc", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	var logged bytes.Buffer
+	srv.ErrorLog = log.New(&logged, "", 0)
+
+	_, err = srv.template("/index.gohtml")
+	var terr *TemplateError
+	if !errors.As(err, &terr) {
+		t.Fatalf("template error: got %v, expected *TemplateError", err)
+	}
+	expected := `gtemplate: /index.gohtml:3: function "broken" not defined`
+	if terr.Line != 3 || terr.Error() != expected {
+		t.Errorf("template error: got line %d %q, expected line 3 %q", terr.Line, terr.Error(), expected)
+	}
+	if errors.Unwrap(terr) == nil {
+		t.Errorf("template error: got no wrapped error")
+	}
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(logged.String(), expected) {
+		t.Errorf("template error: got log %q, expected %q", logged.String(), expected)
+	}
+
+	tests := map[string]struct {
+		name string
+		line int
+	}{
+		"/exec.gohtml":    {"exec.gohtml", 2},
+		"/include.gohtml": {"partial.gohtml", 4},
+		"/index.gohtml":   {"index.gohtml", 3},
+	}
+	errs := srv.Validate()
+	if len(errs) != len(tests) {
+		t.Errorf("template error validate: got %d errors, expected %d", len(errs), len(tests))
+	}
+	for _, err := range errs {
+		var terr *TemplateError
+		if !errors.As(err, &terr) {
+			t.Errorf("template error validate: got %v, expected *TemplateError", err)
+			continue
+		}
+
+		tt := tests[terr.Path]
+		if terr.Name != tt.name || terr.Line != tt.line {
+			t.Errorf("template error validate %q: got %s:%d, expected %s:%d", terr.Path, terr.Name, terr.Line, tt.name, tt.line)
+		}
+	}
+
+	// A directory requested without its trailing slash is quietly not found
+	fsys = fstest.MapFS{
+		"site/blog/index.gohtml": {Data: []byte("{{.title}}")},
+	}
+	srv, err = NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	logged.Reset()
+	srv.ErrorLog = log.New(&logged, "", 0)
+
+	if _, err := srv.template("/blog"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("template error directory: got %v, expected %v", err, fs.ErrNotExist)
+	}
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/blog", nil))
+	if logged.Len() != 0 {
+		t.Errorf("template error directory: got log %q, expected none", logged.String())
+	}
+}
+
+// TestObserver records the events it is notified of.
+type TestObserver struct {
+	mut    sync.Mutex
+	events []string
+}
+
+func (o *TestObserver) record(kind, path string, err error) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	o.events = append(o.events, fmt.Sprintf("%s %s %v", kind, path, err != nil))
+}
+
+func (o *TestObserver) OnLoad(path string, dur time.Duration, err error) {
+	o.record("load", path, err)
+}
+
+func (o *TestObserver) OnRender(path string, dur time.Duration, err error) {
+	o.record("render", path, err)
+}
+
+func TestObserverHooks(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":  {Data: []byte("{{.title}}")},
+		"site/exec.gohtml":   {Data: []byte("{{.title.Missing}}")},
+		"site/broken.gohtml": {Data: []byte("{{ broken")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	obs := new(TestObserver)
+	srv.Observer = obs
+
+	for _, p := range []string{"/", "/", "/exec.gohtml", "/broken.gohtml"} {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", p, nil))
+	}
+
+	expected := []string{
+		"load /index.gohtml false",
+		"render /index.gohtml false",
+		"render /index.gohtml false",
+		"load /exec.gohtml false",
+		"render /exec.gohtml true",
+		"load /broken.gohtml true",
+	}
+	if !reflect.DeepEqual(obs.events, expected) {
+		t.Errorf("observer: got events %q, expected %q", obs.events, expected)
+	}
+}
+
+// TestAnyBroker supplies a struct, and records calls to Data.
+type TestAnyBroker struct {
+	dataCalls *int
+}
+
+type TestAnyPage struct {
+	Path string
+}
+
+func (p TestAnyPage) Upper() string {
+	return strings.ToUpper(p.Path)
+}
+
+func (broker TestAnyBroker) Data(path string) map[string]interface{} {
+	*broker.dataCalls++
+	return map[string]interface{}{"Path": "from the map"}
+}
+
+func (broker TestAnyBroker) AnyData(path string) interface{} {
+	return TestAnyPage{Path: path}
+}
+
+func TestAnyDataBroker(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml": {Data: []byte(`{{.Path}} {{.Upper}}`)},
+	}
+
+	var calls int
+	srv, err := NewServerFS(fsys, "site", TestAnyBroker{dataCalls: &calls})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if expected := "/index.gohtml /INDEX.GOHTML"; w.Body.String() != expected {
+		t.Errorf("any data: got %q, expected %q", w.Body.String(), expected)
+	}
+
+	var buf bytes.Buffer
+	if err := srv.Render(&buf, "/"); err != nil || buf.String() != "/index.gohtml /INDEX.GOHTML" {
+		t.Errorf("any data render: got %q (error %v), expected struct data", buf.String(), err)
+	}
+	if calls != 0 {
+		t.Errorf("any data: got %d calls to Data, expected none", calls)
+	}
+}
+
+func TestFuncsFor(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":        {Data: []byte(`{{greet}}`)},
+		"site/shop/index.gohtml":   {Data: []byte(`{{greet}} {{price 3}}`)},
+		"site/shop/cart.gohtml":    {Data: []byte(`{{greet}} {{price 3}} {{basket}}`)},
+		"site/shop/sale/a.gohtml":  {Data: []byte(`{{price 3}}`)},
+		"site/blog/post.gohtml":    {Data: []byte(`{{price 3}}`)},
+		"site/blog/special.gohtml": {Data: []byte(`{{greet}}`)},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.Funcs = template.FuncMap{"greet": func() string { return "hello" }}
+
+	// Cached before registration, so must be discarded
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/blog/special.gohtml", nil))
+
+	srv.FuncsFor("/shop/", template.FuncMap{
+		"price": func(n int) string { return fmt.Sprintf("£%d", n) },
+	})
+	srv.FuncsFor("/shop/sale/", template.FuncMap{
+		"price": func(n int) string { return fmt.Sprintf("£%d off", n) },
+	})
+	srv.FuncsFor("/shop/cart.gohtml", template.FuncMap{
+		"basket": func() string { return "3 items" },
+	})
+	srv.FuncsFor("/blog/s*.gohtml", template.FuncMap{
+		"greet": func() string { return "hi" },
+	})
+
+	tests := []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{"/", http.StatusOK, "hello"},
+		{"/shop/", http.StatusOK, "hello £3"},
+		{"/shop/cart.gohtml", http.StatusOK, "hello £3 3 items"},
+		{"/shop/sale/a.gohtml", http.StatusOK, "£3 off"},
+		{"/blog/post.gohtml", http.StatusNotFound, ""},
+		{"/blog/special.gohtml", http.StatusOK, "hi"},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.code {
+			t.Errorf("funcs for %q: got status %d, expected %d", elem.path, w.Code, elem.code)
+		}
+		if elem.code == http.StatusOK && w.Body.String() != elem.output {
+			t.Errorf("funcs for %q: got %q, expected %q", elem.path, w.Body.String(), elem.output)
+		}
+	}
+}
+
+func TestIncludesRootInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "header.gohtml")
+	if err := os.WriteFile(file, []byte(`{{define "header"}}Header{{end}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	empty := t.TempDir()
+
+	tests := []struct {
+		name, incroot string
+		err           error
+	}{
+		{"file", file, ErrIncludesInvalid},
+		{"missing", filepath.Join(empty, "notexist"), ErrIncludesInvalid},
+		{"empty path", "", ErrIncludesInvalid},
+		{"empty", empty, nil},
+	}
+
+	for _, elem := range tests {
+		srv, err := NewIncludesServer(TestDocumentRoot, elem.incroot, TestBroker{})
+		if err != elem.err {
+			t.Errorf("includes root %s: got error %v, expected %v", elem.name, err, elem.err)
+		}
+		if err == nil && len(srv.includes) != 0 {
+			t.Errorf("includes root %s: got includes %q, expected none", elem.name, srv.includes)
+		}
+	}
+
+	fsys := fstest.MapFS{
+		"site/index.gohtml": {Data: []byte("index")},
+		"inc":               {Data: []byte("not a directory")},
+	}
+	if _, err := NewIncludesServerFS(fsys, "site", "inc", TestBroker{}); err != ErrIncludesInvalid {
+		t.Errorf("includes root fs file: got error %v, expected %v", err, ErrIncludesInvalid)
+	}
+}
+
+func TestTraversal(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "public")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "index.gohtml"), []byte("index"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.gohtml"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(root, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	for _, follow := range []bool{false, true} {
+		srv.FollowSymlinks = follow
+
+		for _, p := range []string{"/../secret.gohtml", "../secret.gohtml", "/a/../../secret.gohtml", "/public/../../secret.gohtml"} {
+			if _, err := srv.loadTemplate(p); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("traversal %q (follow symlinks %v): got error %v, expected not found", p, follow, err)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = "/../secret.gohtml"
+		srv.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("traversal request (follow symlinks %v): got %d %q, expected 404", follow, w.Code, w.Body.String())
+		}
+	}
+
+	if _, err := srv.loadTemplate("/index.gohtml"); err != nil {
+		t.Errorf("traversal: got error %v loading template within root", err)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":            {Data: []byte("index")},
+		"site/assets/logo.gohtml":      {Data: []byte("logo")},
+		"site/assets/live/feed.gohtml": {Data: []byte("feed")},
+		"site/assets/live/now.gohtml":  {Data: []byte("now")},
+		"site/news.gohtml":             {Data: []byte("news")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.SetCacheControl("/assets/", "public, max-age=86400")
+	srv.SetCacheControl("/assets/live/", "no-cache")
+	srv.SetCacheControl("/assets/live/now.gohtml", "")
+	srv.SetCacheControl("/n*.gohtml", "max-age=60")
+
+	tests := []struct {
+		path, expected string
+	}{
+		{"/", ""},
+		{"/assets/logo.gohtml", "public, max-age=86400"},
+		{"/assets/live/feed.gohtml", "no-cache"},
+		{"/assets/live/now.gohtml", ""},
+		{"/news.gohtml", "max-age=60"},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if cc := w.Header().Get("Cache-Control"); cc != elem.expected {
+			t.Errorf("cache control %q: got %q, expected %q", elem.path, cc, elem.expected)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/assets/missing.gohtml", nil))
+	if cc := w.Header().Get("Cache-Control"); cc != "" {
+		t.Errorf("cache control not found: got %q, expected none", cc)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml": {Data: []byte("{{.title}}")},
+		"site/exec.gohtml":  {Data: []byte("{{.title.Missing}}")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.SecurityHeaders = DefaultSecurityHeaders()
+
+	tests := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/", http.StatusOK},
+		{"GET", "/missing.gohtml", http.StatusNotFound},
+		{"GET", "/exec.gohtml", http.StatusInternalServerError},
+		{"POST", "/", http.StatusMethodNotAllowed},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(elem.method, elem.path, nil))
+
+		if w.Code != elem.code {
+			t.Errorf("security headers %s %q: got status %d, expected %d", elem.method, elem.path, w.Code, elem.code)
+		}
+		for k, v := range DefaultSecurityHeaders() {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("security headers %s %q: got %s %q, expected %q", elem.method, elem.path, k, got, v)
+			}
+		}
+	}
+
+	srv, err = NewServerFS(fsys, "site", StaticBroker{
+		"title":    "My Page",
+		HeadersKey: map[string]string{"X-Frame-Options": "DENY"},
+	})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.SecurityHeaders = DefaultSecurityHeaders()
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("security headers override: got X-Frame-Options %q, expected %q", got, "DENY")
+	}
+}
+
+func TestNoncePolicy(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml": {Data: []byte(`<script nonce="{{.csp_nonce}}"></script>`)},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.SecurityHeaders = DefaultSecurityHeaders()
+	srv.NoncePolicy = "default-src 'self'; script-src 'nonce-{nonce}'"
+
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		var nonce string
+		csp := w.Header().Get("Content-Security-Policy")
+		if _, err := fmt.Sscanf(csp, "default-src 'self'; script-src 'nonce-%s", &nonce); err != nil || !strings.HasSuffix(nonce, "'") {
+			t.Fatalf("nonce: got policy %q, expected nonce substituted", csp)
+		}
+		nonce = strings.TrimSuffix(nonce, "'")
+
+		if len(nonce) < 22 {
+			t.Errorf("nonce: got %q, expected at least 128 bits", nonce)
+		}
+		if seen[nonce] {
+			t.Errorf("nonce: got %q again, expected unique per request", nonce)
+		}
+		seen[nonce] = true
+
+		if expected := `<script nonce="` + nonce + `"></script>`; w.Body.String() != expected {
+			t.Errorf("nonce: got body %q, expected %q", w.Body.String(), expected)
+		}
+	}
+}
+
+func TestContentLayouts(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/layout.gohtml":  {Data: []byte("<main>{{.title}}: {{.content}}</main>")},
+		"site/docs/intro.md":  {Data: []byte("# Hello & welcome")},
+		"site/docs/broken.md": {Data: []byte("")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.ContentLayouts = map[string]ContentLayout{
+		".md": {
+			Layout: "/layout.gohtml",
+			Convert: func(src []byte) (template.HTML, error) {
+				if len(src) == 0 {
+					return "", errors.New("empty document")
+				}
+				// Stands in for a Markdown library
+				heading := strings.TrimPrefix(string(src), "# ")
+				return template.HTML("<h1>" + template.HTMLEscapeString(heading) + "</h1>"), nil
+			},
+		},
+	}
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/docs/intro.md", http.StatusOK, "<main>My Page: <h1>Hello &amp; welcome</h1></main>"},
+		{"/docs/missing.md", http.StatusNotFound, ""},
+		{"/docs/broken.md", http.StatusInternalServerError, ""},
+		{"/layout.gohtml", http.StatusOK, "<main>My Page: </main>"},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.code {
+			t.Errorf("content %q: got status %d, expected %d", elem.path, w.Code, elem.code)
+		}
+		if elem.code == http.StatusOK {
+			if w.Body.String() != elem.body {
+				t.Errorf("content %q: got %q, expected %q", elem.path, w.Body.String(), elem.body)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+				t.Errorf("content %q: got content type %q, expected HTML", elem.path, ct)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := srv.Render(&buf, "/docs/intro.md"); err != nil || buf.String() != tests[0].body {
+		t.Errorf("content render: got %q (error %v), expected %q", buf.String(), err, tests[0].body)
+	}
+}
+
+func TestCookieData(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml": {Data: []byte(`{{.cookies.theme}}|{{.cookies.session}}`)},
+	}
+
+	tests := []struct {
+		enabled bool
+		filter  func(string) bool
+		data    StaticBroker
+		body    string
+	}{
+		{false, nil, StaticBroker{}, "|"},
+		{true, nil, StaticBroker{}, "dark|secret"},
+		{true, func(name string) bool { return name != "session" }, StaticBroker{}, "dark|"},
+		{true, nil, StaticBroker{CookiesKey: map[string]string{"theme": "broker"}}, "broker|"},
+	}
+
+	for i, elem := range tests {
+		srv, err := NewServerFS(fsys, "site", elem.data)
+		if err != nil {
+			t.Fatalf("Server init failed: %s", err.Error())
+		}
+		srv.CookieData = elem.enabled
+		srv.CookieFilter = elem.filter
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+		r.AddCookie(&http.Cookie{Name: "session", Value: "secret"})
+		r.AddCookie(&http.Cookie{Name: "theme", Value: "light"})
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+
+		if w.Body.String() != elem.body {
+			t.Errorf("cookies %d (enabled %v): got %q, expected %q", i, elem.enabled, w.Body.String(), elem.body)
+		}
+	}
+}
+
+// flushRecorder records the length of the body at each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []int
+}
+
+func (w *flushRecorder) Flush() {
+	w.flushes = append(w.flushes, w.Body.Len())
+	w.ResponseRecorder.Flush()
+}
+
+func TestFlushInterval(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/events.gohtml": {Data: []byte("{{range .events}}data: {{.}}\n\n{{end}}")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", StaticBroker{"events": []string{"one", "two", "three"}})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.Unbuffered = true
+
+	tests := []struct {
+		interval time.Duration
+		gzip     bool
+		flushed  bool
+	}{
+		{0, false, false},
+		{time.Hour, false, false},
+		{-1, false, true},
+		{-1, true, true},
+	}
+
+	for _, elem := range tests {
+		srv.FlushInterval = elem.interval
+		srv.Compression = elem.gzip
+
+		r := httptest.NewRequest("GET", "/events.gohtml", nil)
+		if elem.gzip {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		srv.ServeHTTP(w, r)
+
+		body := w.Body.Bytes()
+		if elem.gzip {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err = io.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if expected := "data: one\n\ndata: two\n\ndata: three\n\n"; string(body) != expected {
+			t.Errorf("flush interval %v (gzip %v): got %q, expected %q", elem.interval, elem.gzip, body, expected)
+		}
+
+		// Streamed output is flushed part way through rendering
+		partial := len(w.flushes) > 1 && w.flushes[0] > 0 && w.flushes[0] < w.flushes[len(w.flushes)-1]
+		if partial != elem.flushed {
+			t.Errorf("flush interval %v (gzip %v): got flushes at %v, expected streaming %v", elem.interval, elem.gzip, w.flushes, elem.flushed)
+		}
+	}
+}
+
+func TestStrictData(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/page.gohtml":  {Data: []byte("{{.title}}")},
+		"site/empty.gohtml": {Data: []byte("empty")},
+		"site/none.gohtml":  {Data: []byte("{{.title}}")},
+	}
+
+	broker := NewBroker()
+	broker.HandleData("/page.gohtml", map[string]interface{}{"title": "My Page"})
+	broker.HandleData("/empty.gohtml", map[string]interface{}{})
+
+	srv, err := NewServerFS(fsys, "site", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		strict bool
+		path   string
+		code   int
+	}{
+		{false, "/none.gohtml", http.StatusOK},
+		{true, "/none.gohtml", http.StatusTeapot},
+		{true, "/page.gohtml", http.StatusOK},
+		{true, "/empty.gohtml", http.StatusOK},
+	}
+
+	srv.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, ErrNoData) {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	for _, elem := range tests {
+		srv.StrictData = elem.strict
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+		if w.Code != elem.code {
+			t.Errorf("strict data %q (strict %v): got %d, expected %d", elem.path, elem.strict, w.Code, elem.code)
+		}
+	}
+
+	srv.StrictData = true
+	if err := srv.Render(io.Discard, "/none.gohtml"); !errors.Is(err, ErrNoData) {
+		t.Errorf("strict data render: got error %v, expected %v", err, ErrNoData)
+	}
+}
+
+func TestDefaultData(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/page.gohtml": {Data: []byte("{{.site}}: {{.title}}")},
+		"site/none.gohtml": {Data: []byte("{{.site}}: {{len .}}")},
+	}
+
+	broker := NewBroker()
+	broker.HandleData("/page.gohtml", map[string]interface{}{"title": "My Page", "site": "Override"})
+
+	srv, err := NewServerFS(fsys, "site", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		defaults map[string]interface{}
+		path     string
+		expect   string
+	}{
+		{map[string]interface{}{"site": "My Site", "title": "Untitled"}, "/page.gohtml", "Override: My Page"},
+		{map[string]interface{}{"site": "My Site"}, "/none.gohtml", "My Site: 1"},
+		{nil, "/none.gohtml", ": 0"},
+	}
+	for _, elem := range tests {
+		srv.DefaultData = elem.defaults
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != elem.expect {
+			t.Errorf("default data %q (%v): got %d %q, expected 200 %q", elem.path, elem.defaults, w.Code, w.Body.String(), elem.expect)
+		}
+
+		var buf bytes.Buffer
+		if err := srv.Render(&buf, elem.path); err != nil || buf.String() != elem.expect {
+			t.Errorf("default data render %q (%v): got %q (%v), expected %q", elem.path, elem.defaults, buf.String(), err, elem.expect)
+		}
+	}
+	if title := tests[0].defaults["title"]; title != "Untitled" {
+		t.Errorf("default data: got title %q after render, expected DefaultData unmodified", title)
+	}
+}
+
+// FuncBroker supplies to each path but "/plain.gohtml" a function returning
+// the number of times its functions have been requested.
+type FuncBroker struct {
+	TestBroker
+	mut   sync.Mutex
+	calls int
+}
+
+func (broker *FuncBroker) Funcs(path string) template.FuncMap {
+	if path == "/plain.gohtml" {
+		return nil
+	}
+
+	broker.mut.Lock()
+	defer broker.mut.Unlock()
+	broker.calls++
+
+	n := broker.calls
+	return template.FuncMap{
+		"calls": func() int { return n },
+	}
+}
+
+func TestFuncDataBroker(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml": {Data: []byte("{{.title}} {{calls}}")},
+		"site/robots.txt":   {Data: []byte("{{calls}}")},
+		"site/plain.gohtml": {Data: []byte("{{.title}}")},
+	}
+
+	broker := new(FuncBroker)
+	srv, err := NewServerFS(fsys, "site", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.TextPaths = []string{"/robots.txt"}
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 8)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			bodies[i] = w.Body.String()
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, elem := range bodies {
+		if !strings.HasPrefix(elem, "My Page ") || seen[elem] {
+			t.Errorf("func broker: got %q among %q, expected functions supplied per request", elem, bodies)
+		}
+		seen[elem] = true
+	}
+
+	var buf bytes.Buffer
+	if err := srv.Render(&buf, "/robots.txt"); err != nil || buf.String() == "" {
+		t.Errorf("func broker text: got %q (%v), expected call count", buf.String(), err)
+	}
+	if errs := srv.Validate(); len(errs) != 0 {
+		t.Errorf("func broker validate: got errors %v, expected none", errs)
+	}
+
+	// Clones are pooled by function names, and not made without functions
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		if err := srv.Render(&buf, "/plain.gohtml"); err != nil || buf.String() != "My Page" {
+			t.Errorf("func broker plain: got %q (%v), expected %q", buf.String(), err, "My Page")
+		}
+	}
+	tests := []struct {
+		path  string
+		pools int
+	}{
+		{"/index.gohtml", 1},
+		{"/robots.txt", 1},
+		{"/plain.gohtml", 0},
+	}
+	for _, elem := range tests {
+		ct, _ := srv.cached(elem.path)
+		if ct == nil || ct.sets == nil {
+			t.Errorf("func broker pools %q: got no clones, expected %d pools", elem.path, elem.pools)
+			continue
+		}
+		if got := len(ct.sets.pools); got != elem.pools {
+			t.Errorf("func broker pools %q: got %d, expected %d", elem.path, got, elem.pools)
+		}
+	}
+}
+
+func TestErrorTemplate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/page.gohtml":   {Data: []byte("page {{.error}}")},
+		"site/error.gohtml":  {Data: []byte("<p>failed: {{.error}}</p>")},
+		"site/broken.gohtml": {Data: []byte("partial {{call .nothing}}")},
+	}
+
+	broker := NewBroker()
+	broker.HandleFunc("/page.gohtml", func(path string) (map[string]interface{}, error) {
+		return nil, errors.New("database down")
+	})
+
+	srv, err := NewServerFS(fsys, "site", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+
+	tests := []struct {
+		errorTemplate string
+		code          int
+		body          string
+	}{
+		{"", http.StatusOK, "page database down"},
+		{"/error.gohtml", http.StatusInternalServerError, "<p>failed: database down</p>"},
+		{"/notexist.gohtml", http.StatusInternalServerError, "database down"},
+		{"/broken.gohtml", http.StatusInternalServerError, "database down"},
+	}
+
+	for _, elem := range tests {
+		srv.ErrorTemplate = elem.errorTemplate
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/page.gohtml", nil))
+
+		if w.Code != elem.code {
+			t.Errorf("error template %q: got status %d, expected %d", elem.errorTemplate, w.Code, elem.code)
+		}
+		if !strings.Contains(w.Body.String(), elem.body) {
+			t.Errorf("error template %q: got body %q, expected to contain %q", elem.errorTemplate, w.Body.String(), elem.body)
+		}
+	}
+
+	srv.ErrorTemplate = "/error.gohtml"
+	if err := srv.Render(io.Discard, "/page.gohtml"); !errors.Is(err, ErrBrokerData) {
+		t.Errorf("error template render: got error %v, expected %v", err, ErrBrokerData)
+	}
+}
+
+// SlowBroker blocks until the context of each data request is done, then
+// reports its error.
+type SlowBroker struct {
+	errs chan error
+}
+
+func (broker SlowBroker) Data(path string) map[string]interface{} {
+	return nil
+}
+
+func (broker SlowBroker) DataCtx(ctx context.Context, path string) map[string]interface{} {
+	if path != "/slow.gohtml" {
+		return nil
+	}
+
+	<-ctx.Done()
+	broker.errs <- ctx.Err()
+	return nil
+}
+
+func TestRenderTimeout(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/slow.gohtml": {Data: []byte("slow")},
+		"site/fast.gohtml": {Data: []byte("fast")},
+	}
+
+	broker := SlowBroker{make(chan error, 1)}
+	srv, err := NewServerFS(fsys, "site", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.RenderTimeout = 50 * time.Millisecond
+	srv.SecurityHeaders = DefaultSecurityHeaders()
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/fast.gohtml", http.StatusOK, "fast"},
+		{"/slow.gohtml", http.StatusServiceUnavailable, "503 render timed out"},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.code {
+			t.Errorf("render timeout %q: got status %d, expected %d", elem.path, w.Code, elem.code)
+		}
+		if w.Body.String() != elem.body {
+			t.Errorf("render timeout %q: got body %q, expected %q", elem.path, w.Body.String(), elem.body)
+		}
+		if w.Header().Get("X-Frame-Options") != "SAMEORIGIN" {
+			t.Errorf("render timeout %q: security headers not sent", elem.path)
+		}
+	}
+
+	select {
+	case err := <-broker.errs:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("render timeout: got broker context error %v, expected %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("render timeout: broker context not cancelled")
+	}
+}
+
+func TestHas(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":     {Data: []byte("home")},
+		"site/page.gohtml":      {Data: []byte("page")},
+		"site/broken.gohtml":    {Data: []byte("{{ broken")},
+		"site/sub/index.gohtml": {Data: []byte("sub")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		path string
+		has  bool
+	}{
+		{"/", true},
+		{"/page.gohtml", true},
+		{"/page", true},
+		{"/broken.gohtml", true},
+		{"/sub/", true},
+		{"/sub", false},
+		{"/missing.gohtml", false},
+		{"/../page.gohtml", true},
+	}
+
+	for _, elem := range tests {
+		if has := srv.Has(elem.path); has != elem.has {
+			t.Errorf("has %q: got %t, expected %t", elem.path, has, elem.has)
+		}
+	}
+	if cached := srv.Cached(); len(cached) != 0 {
+		t.Errorf("has: got cached templates %q, expected none", cached)
+	}
+}
+
+func TestUse(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/page.gohtml":    {Data: []byte("page")},
+		"site/private.gohtml": {Data: []byte("secret")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	trace := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Trace", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	srv.Use(trace("first"))
+	srv.Use(trace("second"))
+	srv.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/private.gohtml" {
+				http.Error(w, "403 forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/page.gohtml", http.StatusOK, "page"},
+		{"/private.gohtml", http.StatusForbidden, "403 forbidden\n"},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.code || w.Body.String() != elem.body {
+			t.Errorf("use %q: got %d %q, expected %d %q", elem.path, w.Code, w.Body.String(), elem.code, elem.body)
+		}
+		if trace := w.Header().Values("X-Trace"); !reflect.DeepEqual(trace, []string{"first", "second"}) {
+			t.Errorf("use %q: got middleware order %q, expected first then second", elem.path, trace)
+		}
+	}
+}
+
+// BenchmarkRenderBuffer compares rendering into a fresh buffer for each
+// request with rendering into a pooled buffer, as ServeHTTP does.
+func BenchmarkRenderBuffer(b *testing.B) {
+	srv, err := NewServer(TestDocumentRoot, TestBroker{})
+	if err != nil {
+		b.Fatalf("Server init failed: %s", err.Error())
+	}
+	t, err := srv.template("/index.gohtml")
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := srv.pathData("/index.gohtml")
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var buf bytes.Buffer
+			if err := srv.execute(&buf, "/index.gohtml", t, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := getBuffer()
+			if err := srv.execute(buf, "/index.gohtml", t, data); err != nil {
+				b.Fatal(err)
+			}
+			putBuffer(buf)
+		}
+	})
+}
+
+func TestMaxCached(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/a.gohtml": {Data: []byte("a")},
+		"site/b.gohtml": {Data: []byte("b")},
+		"site/c.gohtml": {Data: []byte("c")},
+		"site/d.gohtml": {Data: []byte("d")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.MaxCached = 2
+
+	tests := []struct {
+		path   string
+		cached []string
+	}{
+		{"/a.gohtml", []string{"/a.gohtml"}},
+		{"/b.gohtml", []string{"/a.gohtml", "/b.gohtml"}},
+		{"/a.gohtml", []string{"/a.gohtml", "/b.gohtml"}},
+		{"/c.gohtml", []string{"/a.gohtml", "/c.gohtml"}},
+		{"/d.gohtml", []string{"/c.gohtml", "/d.gohtml"}},
+		{"/a.gohtml", []string{"/a.gohtml", "/d.gohtml"}},
+	}
+
+	for i, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Body.String() != strings.TrimSuffix(path.Base(elem.path), ".gohtml") {
+			t.Errorf("max cached %d %q: got body %q", i, elem.path, w.Body.String())
+		}
+		if cached := srv.Cached(); !reflect.DeepEqual(cached, elem.cached) {
+			t.Errorf("max cached %d %q: got cached %q, expected %q", i, elem.path, cached, elem.cached)
+		}
+	}
+
+	if s := srv.Stats(); s.Evictions != 3 || s.Hits != 1 {
+		t.Errorf("max cached: got %d evictions and %d hits, expected 3 and 1", s.Evictions, s.Hits)
+	}
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":      {Data: []byte("home")},
+		"site/about.gohtml":      {Data: []byte("about")},
+		"site/blog/index.gohtml": {Data: []byte("blog")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		status   int
+		path     string
+		code     int
+		location string
+	}{
+		{0, "/about/", http.StatusNotFound, ""},
+		{http.StatusMovedPermanently, "/about/", http.StatusMovedPermanently, "/about"},
+		{http.StatusMovedPermanently, "/about.gohtml/", http.StatusMovedPermanently, "/about.gohtml"},
+		{http.StatusPermanentRedirect, "/blog?page=2", http.StatusPermanentRedirect, "/blog/?page=2"},
+		{http.StatusMovedPermanently, "/about", http.StatusOK, ""},
+		{http.StatusMovedPermanently, "/missing/", http.StatusNotFound, ""},
+	}
+
+	for _, elem := range tests {
+		srv.TrailingSlashRedirect = elem.status
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.code {
+			t.Errorf("trailing slash %d %q: got status %d, expected %d", elem.status, elem.path, w.Code, elem.code)
+		}
+		if loc := w.Header().Get("Location"); loc != elem.location {
+			t.Errorf("trailing slash %d %q: got location %q, expected %q", elem.status, elem.path, loc, elem.location)
+		}
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/about/team.gohtml": {Data: []byte("team {{.path}}")},
+		"site/Page.gohtml":       {Data: []byte("upper")},
+		"site/page.gohtml":       {Data: []byte("lower")},
+		"site/style.css":         {Data: []byte("body {}")},
+	}
+
+	broker := NewBroker()
+	broker.HandleFunc("/about/team.gohtml", func(path string) (map[string]interface{}, error) {
+		return map[string]interface{}{"path": path}, nil
+	})
+
+	srv, err := NewServerFS(fsys, "site", broker)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.StaticExtensions = []string{".css"}
+
+	tests := []struct {
+		insensitive bool
+		path        string
+		code        int
+		body        string
+	}{
+		{false, "/About/Team.gohtml", http.StatusNotFound, ""},
+		{true, "/About/Team.gohtml", http.StatusOK, "team /about/team.gohtml"},
+		{true, "/ABOUT/TEAM", http.StatusOK, "team /about/team.gohtml"},
+		{true, "/page.gohtml", http.StatusOK, "lower"},
+		{true, "/Page.gohtml", http.StatusOK, "upper"},
+		{true, "/PAGE.GOHTML", http.StatusOK, "upper"},
+		{true, "/Style.CSS", http.StatusOK, "body {}"},
+		{true, "/Missing/Team.gohtml", http.StatusNotFound, ""},
+	}
+
+	for _, elem := range tests {
+		srv.CaseInsensitive = elem.insensitive
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != elem.code {
+			t.Errorf("case insensitive %t %q: got status %d, expected %d", elem.insensitive, elem.path, w.Code, elem.code)
+		}
+		if elem.body != "" && w.Body.String() != elem.body {
+			t.Errorf("case insensitive %t %q: got body %q, expected %q", elem.insensitive, elem.path, w.Body.String(), elem.body)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// LiveReloadPath is the path of the Server-Sent Events endpoint to which
+// pages connect when LiveReload is enabled.
+const LiveReloadPath = "/_gtemplate/livereload"
+
+// liveReloadPoll is how often the live reload endpoint checks for changes.
+var liveReloadPoll = 500 * time.Millisecond
+
+// liveReloadScript is injected into pages to reload them on change.
+var liveReloadScript = template.Must(template.New("livereload").Parse(
+	`<script{{with .}} nonce="{{.}}"{{end}}>` +
+		`new EventSource("` + LiveReloadPath + `").addEventListener("reload", function() { location.reload(); });` +
+		`</script>`))
+
+// injectLiveReload returns body with the live reload script inserted before
+// its closing body tag, or appended if it has none. Nonce is the nonce of
+// the request's NoncePolicy, if any.
+func injectLiveReload(body []byte, nonce interface{}) []byte {
+	var script bytes.Buffer
+	liveReloadScript.Execute(&script, nonce)
+
+	i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	if i < 0 {
+		return append(body, script.Bytes()...)
+	}
+
+	out := make([]byte, 0, len(body)+script.Len())
+	out = append(out, body[:i]...)
+	out = append(out, script.Bytes()...)
+	return append(out, body[i:]...)
+}
+
+// stamp returns the combined stamp of the document and include roots.
+func (srv *TemplateServer) stamp() [2]dirStamp {
+	var stamp [2]dirStamp
+	stamp[0] = stampDir(srv.fsys, ".")
+	if srv.incfs != nil {
+		stamp[1] = srv.includeStamp()
+	}
+
+	return stamp
+}
+
+// serveLiveReload serves the live reload endpoint, sending a reload event
+// once any file in the document or include root changes.
+func (srv *TemplateServer) serveLiveReload(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Taken before responding, so that no change is missed
+	initial := srv.stamp()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": watching for changes\n\n")
+	f.Flush()
+
+	tick := time.NewTicker(liveReloadPoll)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+			if srv.stamp() != initial {
+				fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+				f.Flush()
+				return
+			}
+		}
+	}
+}
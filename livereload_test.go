@@ -0,0 +1,135 @@
+package gtemplate
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestInjectLiveReload(t *testing.T) {
+	tests := []struct {
+		body  string
+		nonce interface{}
+		check func(string) bool
+	}{
+		{"<html><body><p>Hi</p></body></html>", nil, func(out string) bool {
+			return strings.HasPrefix(out, "<html><body><p>Hi</p><script>") && strings.HasSuffix(out, "</script></body></html>")
+		}},
+		{"<p>No body</p>", nil, func(out string) bool {
+			return strings.HasPrefix(out, "<p>No body</p><script>")
+		}},
+		{"<BODY>Upper</BODY>", "abc123", func(out string) bool {
+			return strings.Contains(out, `<script nonce="abc123">`) && strings.HasSuffix(out, "</script></BODY>")
+		}},
+	}
+
+	for _, elem := range tests {
+		out := string(injectLiveReload([]byte(elem.body), elem.nonce))
+		if !elem.check(out) || !strings.Contains(out, LiveReloadPath) {
+			t.Errorf("inject %q: got %q", elem.body, out)
+		}
+	}
+}
+
+func TestLiveReloadInjection(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml": {Data: []byte("<body>{{.title}}</body>")},
+		"site/robots.txt":   {Data: []byte("User-agent: *")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.TextPaths = []string{"/robots.txt"}
+
+	tests := []struct {
+		dev, live bool
+		path      string
+		injected  bool
+	}{
+		{false, false, "/", false},
+		{false, true, "/", false},
+		{true, false, "/", false},
+		{true, true, "/", true},
+		{true, true, "/robots.txt", false},
+	}
+
+	for _, elem := range tests {
+		srv.DevMode, srv.LiveReload = elem.dev, elem.live
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+		if injected := strings.Contains(w.Body.String(), LiveReloadPath); injected != elem.injected {
+			t.Errorf("live reload %q (dev %v, live %v): got %q, expected injected %v", elem.path, elem.dev, elem.live, w.Body.String(), elem.injected)
+		}
+	}
+
+	srv.DevMode, srv.LiveReload = false, true
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", LiveReloadPath, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("live reload endpoint outside dev mode: got %d, expected %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestLiveReloadEvent(t *testing.T) {
+	poll := liveReloadPoll
+	liveReloadPoll = 10 * time.Millisecond
+	defer func() { liveReloadPoll = poll }()
+
+	root := t.TempDir()
+	file := filepath.Join(root, "index.gohtml")
+	if err := os.WriteFile(file, []byte("before"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServerOpts(root, WithBroker(TestBroker{}), WithDevMode(true))
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.LiveReload = true
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + LiveReloadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("live reload: got content type %q, expected text/event-stream", ct)
+	}
+
+	events := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if strings.HasPrefix(sc.Text(), "event: ") {
+				events <- strings.TrimPrefix(sc.Text(), "event: ")
+			}
+		}
+		close(events)
+	}()
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev := <-events:
+		if ev != "reload" {
+			t.Errorf("live reload: got event %q, expected reload", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("live reload: got no event after change")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the render duration
+// histogram buckets kept by Metrics.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Metrics is an Observer which counts the requests, loads and renders of a
+// TemplateServer, and records a histogram of render durations. It serves the
+// metrics in the Prometheus text exposition format, and a Snapshot may be
+// used to implement a prometheus.Collector without this package depending on
+// Prometheus, for example:
+//
+//	m := gtemplate.NewMetrics(srv)
+//	http.Handle("/", m.Handler(srv))
+//	http.Handle("/metrics", m)
+//
+// Servers without Metrics pay nothing for them.
+type Metrics struct {
+	srv  *TemplateServer
+	next Observer
+
+	mut          sync.Mutex
+	statuses     map[int]uint64
+	loads        uint64
+	loadErrors   uint64
+	renderErrors uint64
+	render       histogram
+}
+
+// histogram is a histogram of durations with fixed buckets.
+type histogram struct {
+	counts []uint64 // per bucket of DefaultBuckets, then +Inf
+	sum    float64
+	count  uint64
+}
+
+// observe records v, in seconds.
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(DefaultBuckets)+1)
+	}
+
+	i := sort.SearchFloat64s(DefaultBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// NewMetrics returns Metrics which observe srv, installing them as its
+// Observer. Any Observer already set continues to be notified. Requests are
+// only counted when served through the handler returned by Handler.
+func NewMetrics(srv *TemplateServer) *Metrics {
+	m := &Metrics{srv: srv, next: srv.Observer}
+	srv.Observer = m
+
+	return m
+}
+
+// OnLoad counts a template load.
+func (m *Metrics) OnLoad(path string, dur time.Duration, err error) {
+	m.mut.Lock()
+	m.loads++
+	if err != nil {
+		m.loadErrors++
+	}
+	m.mut.Unlock()
+
+	if m.next != nil {
+		m.next.OnLoad(path, dur, err)
+	}
+}
+
+// OnRender records a template render in the render duration histogram.
+func (m *Metrics) OnRender(path string, dur time.Duration, err error) {
+	m.mut.Lock()
+	m.render.observe(dur.Seconds())
+	if err != nil {
+		m.renderErrors++
+	}
+	m.mut.Unlock()
+
+	if m.next != nil {
+		m.next.OnRender(path, dur, err)
+	}
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying writer, if supported.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Handler wraps h, usually the observed server, counting its requests by
+// response status.
+func (m *Metrics) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+
+			m.mut.Lock()
+			if m.statuses == nil {
+				m.statuses = make(map[int]uint64)
+			}
+			m.statuses[sw.status]++
+			m.mut.Unlock()
+		}()
+
+		h.ServeHTTP(sw, r)
+	})
+}
+
+// Histogram is a snapshot of a histogram, in the form expected by
+// prometheus.MustNewConstHistogram.
+type Histogram struct {
+	Count   uint64
+	Sum     float64
+	Buckets map[float64]uint64 // cumulative counts by upper bound
+}
+
+// MetricsSnapshot is a snapshot of the values recorded by Metrics.
+type MetricsSnapshot struct {
+	Requests       uint64         // requests served through Handler
+	Statuses       map[int]uint64 // requests by response status
+	Loads          uint64         // templates loaded, including failures
+	LoadErrors     uint64         // templates which failed to load
+	RenderErrors   uint64         // renders which failed
+	RenderDuration Histogram      // render durations in seconds
+	ServerStats                   // cache statistics of the server
+}
+
+// Snapshot returns the current values of the metrics.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	s := MetricsSnapshot{
+		Statuses:     make(map[int]uint64, len(m.statuses)),
+		Loads:        m.loads,
+		LoadErrors:   m.loadErrors,
+		RenderErrors: m.renderErrors,
+		RenderDuration: Histogram{
+			Count:   m.render.count,
+			Sum:     m.render.sum,
+			Buckets: make(map[float64]uint64, len(DefaultBuckets)),
+		},
+		ServerStats: m.srv.Stats(),
+	}
+	for code, n := range m.statuses {
+		s.Statuses[code] = n
+		s.Requests += n
+	}
+
+	var n uint64
+	for i, le := range DefaultBuckets {
+		if m.render.counts != nil {
+			n += m.render.counts[i]
+		}
+		s.RenderDuration.Buckets[le] = n
+	}
+
+	return s
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := m.Snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	codes := make([]int, 0, len(s.Statuses))
+	for code := range s.Statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	fmt.Fprintln(w, "# TYPE gtemplate_requests_total counter")
+	for _, code := range codes {
+		fmt.Fprintf(w, "gtemplate_requests_total{code=\"%d\"} %d\n", code, s.Statuses[code])
+	}
+
+	counters := []struct {
+		name string
+		v    uint64
+	}{
+		{"gtemplate_template_loads_total", s.Loads},
+		{"gtemplate_template_load_errors_total", s.LoadErrors},
+		{"gtemplate_render_errors_total", s.RenderErrors},
+		{"gtemplate_cache_hits_total", s.Hits},
+		{"gtemplate_cache_misses_total", s.Misses},
+		{"gtemplate_cache_evictions_total", s.Evictions},
+	}
+	for _, elem := range counters {
+		fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", elem.name, elem.name, elem.v)
+	}
+	fmt.Fprintf(w, "# TYPE gtemplate_cached_templates gauge\ngtemplate_cached_templates %d\n", s.CachedTemplates)
+
+	fmt.Fprintln(w, "# TYPE gtemplate_render_duration_seconds histogram")
+	for _, le := range DefaultBuckets {
+		fmt.Fprintf(w, "gtemplate_render_duration_seconds_bucket{le=\"%s\"} %d\n",
+			strconv.FormatFloat(le, 'g', -1, 64), s.RenderDuration.Buckets[le])
+	}
+	fmt.Fprintf(w, "gtemplate_render_duration_seconds_bucket{le=\"+Inf\"} %d\n", s.RenderDuration.Count)
+	fmt.Fprintf(w, "gtemplate_render_duration_seconds_sum %s\n", strconv.FormatFloat(s.RenderDuration.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "gtemplate_render_duration_seconds_count %d\n", s.RenderDuration.Count)
+}
@@ -0,0 +1,73 @@
+package gtemplate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMetrics(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.gohtml":  {Data: []byte("{{.title}}")},
+		"site/exec.gohtml":   {Data: []byte("{{.title.Missing}}")},
+		"site/broken.gohtml": {Data: []byte("{{ broken")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	obs := new(TestObserver)
+	srv.Observer = obs
+
+	m := NewMetrics(srv)
+	hndl := m.Handler(srv)
+	for _, p := range []string{"/", "/", "/exec.gohtml", "/broken.gohtml", "/nonexistent.gohtml"} {
+		hndl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", p, nil))
+	}
+
+	s := m.Snapshot()
+	if s.Requests != 5 {
+		t.Errorf("metrics: got %d requests, expected 5", s.Requests)
+	}
+	statuses := map[int]uint64{
+		http.StatusOK:                  2,
+		http.StatusInternalServerError: 1,
+		http.StatusNotFound:            2,
+	}
+	for code, n := range statuses {
+		if s.Statuses[code] != n {
+			t.Errorf("metrics status %d: got %d, expected %d", code, s.Statuses[code], n)
+		}
+	}
+	if s.Loads != 4 || s.LoadErrors != 2 {
+		t.Errorf("metrics: got %d loads with %d errors, expected 4 with 2", s.Loads, s.LoadErrors)
+	}
+	if s.RenderDuration.Count != 3 || s.RenderErrors != 1 {
+		t.Errorf("metrics: got %d renders with %d errors, expected 3 with 1", s.RenderDuration.Count, s.RenderErrors)
+	}
+	if s.Hits != 1 || s.Misses != 4 {
+		t.Errorf("metrics: got %d hits and %d misses, expected 1 and 4", s.Hits, s.Misses)
+	}
+	if last := s.RenderDuration.Buckets[DefaultBuckets[len(DefaultBuckets)-1]]; last > s.RenderDuration.Count {
+		t.Errorf("metrics: got cumulative bucket count %d, expected at most %d", last, s.RenderDuration.Count)
+	}
+	if len(obs.events) != 7 {
+		t.Errorf("metrics: got previous observer events %q, expected all 7 forwarded", obs.events)
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`gtemplate_requests_total{code="404"} 2`,
+		`gtemplate_template_loads_total 4`,
+		`gtemplate_render_duration_seconds_bucket{le="+Inf"} 3`,
+		`gtemplate_render_duration_seconds_count 3`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics exposition: missing line %q in %q", line, w.Body.String())
+		}
+	}
+}
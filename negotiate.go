@@ -0,0 +1,129 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Variant is an alternative form of templates, served in their place to
+// clients preferring its media type. See TemplateServer.Variants.
+type Variant struct {
+	// MediaType is the media type of the variant, such as
+	// "application/json", sent as its Content-Type.
+	MediaType string
+
+	// Suffix is inserted before the template extension to find the
+	// variant of a template, such that the ".json" variant of
+	// "/page.gohtml" is "/page.json.gohtml".
+	Suffix string
+
+	// Text causes the variant to be rendered using text/template rather
+	// than html/template, as is needed for output which is not HTML.
+	Text bool
+}
+
+// contentType returns the Content-Type header for the variant.
+func (v Variant) contentType() string {
+	if strings.HasPrefix(v.MediaType, "text/") && !strings.Contains(v.MediaType, ";") {
+		return v.MediaType + "; charset=utf-8"
+	}
+
+	return v.MediaType
+}
+
+// variant returns the variant of which the template at p is a form, if any.
+func (srv *TemplateServer) variant(p string) (Variant, bool) {
+	for _, elem := range srv.Variants {
+		if elem.Suffix != "" && strings.HasSuffix(p, elem.Suffix+srv.Extension) {
+			return elem, true
+		}
+	}
+
+	return Variant{}, false
+}
+
+// accepted is a media range from an Accept header.
+type accepted struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media ranges of an Accept header acceptable to the
+// client, in decreasing order of preference.
+func parseAccept(header string) []accepted {
+	var ranges []accepted
+	for _, elem := range strings.Split(header, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(elem))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, accepted{mt, q})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// matches reports whether the media range a includes the media type mt.
+func (a accepted) matches(mt string) bool {
+	if a.mediaType == "*/*" || a.mediaType == mt {
+		return true
+	}
+
+	return strings.HasSuffix(a.mediaType, "/*") &&
+		strings.HasPrefix(mt, strings.TrimSuffix(a.mediaType, "*"))
+}
+
+// negotiate returns the path and template of the variant of the template at
+// p most preferred by the Accept header of r. If the template itself is
+// preferred, or no acceptable variant exists, ok is false.
+func (srv *TemplateServer) negotiate(r *http.Request, p string) (string, *cachedTemplate, bool) {
+	ranges := parseAccept(r.Header.Get("Accept"))
+	if len(ranges) == 0 {
+		return "", nil, false
+	}
+
+	def, _, _ := mime.ParseMediaType(srv.contentType(p))
+	base := strings.TrimSuffix(p, path.Ext(p))
+	for _, a := range ranges {
+		if def != "" && a.matches(def) {
+			return "", nil, false
+		}
+
+		for _, v := range srv.Variants {
+			if !a.matches(v.MediaType) {
+				continue
+			}
+
+			// Missing variants are not loaded, as failed loads are
+			// not cached
+			vp := base + v.Suffix + path.Ext(p)
+			if !srv.exists(vp) {
+				continue
+			}
+			if t, err := srv.template(vp); err == nil {
+				return vp, t, true
+			}
+		}
+	}
+
+	return "", nil, false
+}
@@ -0,0 +1,89 @@
+package gtemplate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseAccept(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected []accepted
+	}{
+		{"", nil},
+		{"application/json", []accepted{{"application/json", 1}}},
+		{"text/html;q=0.5, application/json", []accepted{{"application/json", 1}, {"text/html", 0.5}}},
+		{"text/plain;q=0, */*;q=0.1", []accepted{{"*/*", 0.1}}},
+		{"text/html, application/xhtml+xml, */*;q=0.8", []accepted{{"text/html", 1}, {"application/xhtml+xml", 1}, {"*/*", 0.8}}},
+		{"garbage/, application/json;q=bad, text/csv", []accepted{{"text/csv", 1}}},
+	}
+
+	for _, elem := range tests {
+		if got := parseAccept(elem.header); !reflect.DeepEqual(got, elem.expected) {
+			t.Errorf("accept %q: got %v, expected %v", elem.header, got, elem.expected)
+		}
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/page.gohtml":      {Data: []byte("<h1>{{.title}}</h1>")},
+		"site/page.json.gohtml": {Data: []byte(`{"title": "{{.title}}"}`)},
+		"site/other.gohtml":     {Data: []byte("<p>{{.title}}</p>")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", StaticBroker{"title": `"Quoted" & <b>`})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.Variants = []Variant{
+		{MediaType: "application/json", Suffix: ".json", Text: true},
+	}
+
+	tests := []struct {
+		path, accept string
+		ctype, body  string
+	}{
+		{"/page.gohtml", "", "text/html; charset=utf-8", "<h1>&#34;Quoted&#34; &amp; &lt;b&gt;</h1>"},
+		{"/page.gohtml", "application/json", "application/json", `{"title": ""Quoted" & <b>"}`},
+		{"/page.gohtml", "text/html, */*;q=0.8", "text/html; charset=utf-8", "<h1>&#34;Quoted&#34; &amp; &lt;b&gt;</h1>"},
+		{"/page.gohtml", "text/html;q=0.5, application/*", "application/json", `{"title": ""Quoted" & <b>"}`},
+		{"/page.gohtml", "text/csv", "text/html; charset=utf-8", "<h1>&#34;Quoted&#34; &amp; &lt;b&gt;</h1>"},
+		{"/other.gohtml", "application/json", "text/html; charset=utf-8", "<p>&#34;Quoted&#34; &amp; &lt;b&gt;</p>"},
+		{"/page.json.gohtml", "", "application/json", `{"title": ""Quoted" & <b>"}`},
+	}
+
+	for _, elem := range tests {
+		r := httptest.NewRequest("GET", elem.path, nil)
+		if elem.accept != "" {
+			r.Header.Set("Accept", elem.accept)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || w.Body.String() != elem.body {
+			t.Errorf("negotiate %q (accept %q): got %d %q, expected %q", elem.path, elem.accept, w.Code, w.Body.String(), elem.body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != elem.ctype {
+			t.Errorf("negotiate %q (accept %q): got content type %q, expected %q", elem.path, elem.accept, ct, elem.ctype)
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("negotiate %q (accept %q): got vary %q, expected Accept", elem.path, elem.accept, w.Header().Get("Vary"))
+		}
+	}
+	// Missing variants are not loaded
+	obs := new(TestObserver)
+	srv.Observer = obs
+	r := httptest.NewRequest("GET", "/other.gohtml", nil)
+	r.Header.Set("Accept", "application/json")
+	srv.ServeHTTP(httptest.NewRecorder(), r)
+	for _, elem := range obs.events {
+		if strings.HasPrefix(elem, "load /other.json.gohtml") {
+			t.Errorf("negotiate missing variant: got event %q, expected no load", elem)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"html/template"
+	"os"
+)
+
+// A ServerOption configures a TemplateServer created by NewServerOpts.
+type ServerOption func(*serverConfig)
+
+// serverConfig is the configuration assembled from ServerOptions.
+type serverConfig struct {
+	broker       DataBroker
+	includes     string
+	withIncludes bool
+	incPattern   string
+	incNames     bool
+	incDepth     int
+	funcs        template.FuncMap
+	left, right  string
+	devMode      bool
+	index        string
+	extension    string
+	missingKey   string
+	textMode     bool
+	serveStale   bool
+	sharedRoot   bool
+	rootTemplate string
+}
+
+// WithBroker sets the DataBroker which supplies the data for each template.
+// Without this option, DefaultDataBroker is used. A Broker takes its
+// Extension and Index from the server, unless either is already set.
+func WithBroker(data DataBroker) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.broker = data
+	}
+}
+
+// WithIncludes enables includes support, loading the templates in
+// includeRoot for use by every other template. See NewIncludesServer.
+func WithIncludes(includeRoot string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.includes = includeRoot
+		cfg.withIncludes = true
+	}
+}
+
+// WithIncludePattern loads only the files in the include root whose names
+// match pattern as includes. See TemplateServer.IncludePattern.
+func WithIncludePattern(pattern string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.incPattern = pattern
+	}
+}
+
+// WithNamespacedIncludes names includes by their path within the include
+// root. See TemplateServer.NamespaceIncludes.
+func WithNamespacedIncludes() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.incNames = true
+	}
+}
+
+// WithMaxIncludeDepth limits the depth of directories searched for includes.
+// See TemplateServer.MaxIncludeDepth.
+func WithMaxIncludeDepth(depth int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.incDepth = depth
+	}
+}
+
+// WithFuncs makes the functions in funcs available to all templates. See
+// TemplateServer.Funcs.
+func WithFuncs(funcs template.FuncMap) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.funcs = funcs
+	}
+}
+
+// WithDelims sets the action delimiters used when parsing templates. See
+// TemplateServer.LeftDelim.
+func WithDelims(left, right string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.left, cfg.right = left, right
+	}
+}
+
+// WithDevMode enables re-parsing of templates whose files have changed. See
+// TemplateServer.DevMode.
+func WithDevMode(enabled bool) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.devMode = enabled
+	}
+}
+
+// WithServeStale continues to serve the last version of a template to parse
+// successfully when, in dev mode, a change fails to parse. See
+// TemplateServer.ServeStale.
+func WithServeStale() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.serveStale = true
+	}
+}
+
+// WithIndex sets the file name of the template served for directories. See
+// TemplateServer.Index.
+func WithIndex(name string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.index = name
+	}
+}
+
+// WithRootTemplate sets the template served for the root of the server in
+// place of its index. See TemplateServer.RootTemplate.
+func WithRootTemplate(p string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.rootTemplate = p
+	}
+}
+
+// WithExtension sets the file extension of templates. See
+// TemplateServer.Extension.
+func WithExtension(ext string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.extension = ext
+	}
+}
+
+// WithMissingKey sets the behaviour of templates when the data lacks a key
+// they use, such as "error". See TemplateServer.MissingKey.
+func WithMissingKey(mode string) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.missingKey = mode
+	}
+}
+
+// WithTextMode renders all templates using text/template, without HTML
+// escaping. See TemplateServer.TextMode for the security implications.
+func WithTextMode() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.textMode = true
+	}
+}
+
+// WithSharedRoot parses all templates in the document root into a single
+// set, so that each may execute any other. See TemplateServer.SharedRoot.
+func WithSharedRoot() ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.sharedRoot = true
+	}
+}
+
+// NewServerOpts instantiates a new TemplateServer serving templates from
+// root, configured by opts. Options are applied in order, so later options
+// override earlier ones. Error is returned if root, or the include root if
+// given, is not a valid directory.
+func NewServerOpts(root string, opts ...ServerOption) (*TemplateServer, error) {
+	var cfg serverConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if !verifyDirectory(root) {
+		return nil, ErrRootInvalid
+	}
+
+	srv := newServer(os.DirFS(root), cfg.broker)
+	srv.root = root
+	srv.Funcs = cfg.funcs
+	srv.LeftDelim, srv.RightDelim = cfg.left, cfg.right
+	srv.DevMode = cfg.devMode
+	srv.ServeStale = cfg.serveStale
+	srv.Index = cfg.index
+	srv.RootTemplate = cfg.rootTemplate
+	srv.MissingKey = cfg.missingKey
+	srv.TextMode = cfg.textMode
+	srv.SharedRoot = cfg.sharedRoot
+	srv.IncludePattern = cfg.incPattern
+	srv.NamespaceIncludes = cfg.incNames
+	srv.MaxIncludeDepth = cfg.incDepth
+	if cfg.extension != "" {
+		srv.Extension = cfg.extension
+	}
+	if b, ok := srv.broker.(*Broker); ok {
+		b.adopt(srv.Extension, srv.Index)
+	}
+
+	if cfg.withIncludes {
+		err := srv.loadIncludes(cfg.includes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return srv, nil
+}
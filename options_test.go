@@ -0,0 +1,404 @@
+package gtemplate
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewServerOpts(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"home.tmpl":     `<p><< shout .title >></p>`,
+		"sub/home.tmpl": `<p>Sub << .author >></p>`,
+		"page.tmpl":     `<p>{{ not an action }}</p>`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv, err := NewServerOpts(root,
+		WithBroker(TestBroker{}),
+		WithFuncs(template.FuncMap{"shout": strings.ToUpper}),
+		WithDelims("<<", ">>"),
+		WithIndex("home.tmpl"),
+		WithExtension(".tmpl"),
+	)
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/", "<p>MY PAGE</p>"},
+		{"/sub/", "<p>Sub Ethan Marshall</p>"},
+		{"/page", "<p>{{ not an action }}</p>"},
+	}
+
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Code != http.StatusOK || w.Body.String() != elem.body {
+			t.Errorf("options %q: got %d %q, expected %q", elem.path, w.Code, w.Body.String(), elem.body)
+		}
+	}
+
+	broker := NewBroker()
+	if _, err := NewServerOpts(root, WithBroker(broker), WithIndex("home.tmpl"), WithExtension(".tmpl")); err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	if broker.Extension != ".tmpl" || broker.Index != "home.tmpl" {
+		t.Errorf("options broker: got extension %q index %q, expected %q %q", broker.Extension, broker.Index, ".tmpl", "home.tmpl")
+	}
+
+	if _, err := NewServerOpts("testing/notexist"); err != ErrRootInvalid {
+		t.Errorf("options invalid root: got error %v, expected %v", err, ErrRootInvalid)
+	}
+	if _, err := NewServerOpts(root, WithIncludes("")); err != ErrIncludesInvalid {
+		t.Errorf("options invalid includes: got error %v, expected %v", err, ErrIncludesInvalid)
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "index.gohtml")
+
+	for _, dev := range []bool{false, true} {
+		if err := os.WriteFile(file, []byte("before"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		srv, err := NewServerOpts(root, WithBroker(TestBroker{}), WithDevMode(dev))
+		if err != nil {
+			t.Fatalf("Server init failed: %s", err.Error())
+		}
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if err := os.WriteFile(file, []byte("after"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		expect := "before"
+		if dev {
+			expect = "after"
+		}
+		if w.Body.String() != expect {
+			t.Errorf("dev mode %v: got %q after change, expected %q", dev, w.Body.String(), expect)
+		}
+	}
+}
+
+func TestDevModeIncludes(t *testing.T) {
+	root, incroot := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.gohtml"), []byte(`{{template "header"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	header := filepath.Join(incroot, "header.gohtml")
+
+	for _, dev := range []bool{false, true} {
+		if err := os.WriteFile(header, []byte(`{{define "header"}}before{{end}}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		srv, err := NewServerOpts(root, WithBroker(TestBroker{}), WithIncludes(incroot), WithDevMode(dev))
+		if err != nil {
+			t.Fatalf("Server init failed: %s", err.Error())
+		}
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if err := os.WriteFile(header, []byte(`{{define "header"}}after{{end}}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(header, later, later); err != nil {
+			t.Fatal(err)
+		}
+
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		expect := "before"
+		if dev {
+			expect = "after"
+		}
+		if w.Body.String() != expect {
+			t.Errorf("dev mode %v: got %q after include change, expected %q", dev, w.Body.String(), expect)
+		}
+	}
+}
+
+func TestSharedRoot(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"index.gohtml":         `{{template "sidebar"}} {{template "blog/post.gohtml" .}}`,
+		"sidebar.gohtml":       `{{define "sidebar"}}before{{end}}`,
+		"blog/post.gohtml":     `{{.title}}`,
+		"blog/notfound.gohtml": `{{template "missing"}}`,
+	}
+	for name, text := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	isolated, err := NewServerOpts(root, WithBroker(TestBroker{}))
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	isolated.ErrorLog = log.New(io.Discard, "", 0)
+	w := httptest.NewRecorder()
+	isolated.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code == http.StatusOK {
+		t.Errorf("shared root disabled: got %d %q, expected error", w.Code, w.Body.String())
+	}
+
+	srv, err := NewServerOpts(root, WithBroker(TestBroker{}), WithSharedRoot(), WithDevMode(true))
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+
+	tests := []struct {
+		path   string
+		code   int
+		expect string
+	}{
+		{"/", http.StatusOK, "before My Page"},
+		{"/blog/post.gohtml", http.StatusOK, "My Page"},
+		{"/sidebar.gohtml", http.StatusOK, ""},
+		{"/blog/notfound.gohtml", http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || (tt.code == http.StatusOK && w.Body.String() != tt.expect) {
+			t.Errorf("shared root %q: got %d %q, expected %d %q", tt.path, w.Code, w.Body.String(), tt.code, tt.expect)
+		}
+	}
+
+	first, _ := srv.cached("/index.gohtml")
+	second, _ := srv.cached("/blog/post.gohtml")
+	if first == nil || second == nil || first.renderer != second.renderer {
+		t.Errorf("shared root: got templates %q in separate sets, expected one set", srv.Cached())
+	}
+
+	sidebar := filepath.Join(root, "sidebar.gohtml")
+	if err := os.WriteFile(sidebar, []byte(`{{define "sidebar"}}after{{end}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(sidebar, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.HasPrefix(w.Body.String(), "after ") {
+		t.Errorf("shared root dev mode: got %q after change, expected \"after ...\"", w.Body.String())
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "index.gohtml")
+
+	for _, stale := range []bool{false, true} {
+		if err := os.WriteFile(file, []byte("good"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		opts := []ServerOption{WithBroker(TestBroker{}), WithDevMode(true)}
+		if stale {
+			opts = append(opts, WithServeStale())
+		}
+		srv, err := NewServerOpts(root, opts...)
+		if err != nil {
+			t.Fatalf("Server init failed: %s", err.Error())
+		}
+		srv.ErrorLog = log.New(io.Discard, "", 0)
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if err := os.WriteFile(file, []byte("{{ broken"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			w = httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+			if stale && (w.Code != http.StatusOK || w.Body.String() != "good") {
+				t.Errorf("serve stale: got %d %q after broken change, expected 200 \"good\"", w.Code, w.Body.String())
+			}
+			if !stale && w.Code == http.StatusOK {
+				t.Errorf("no serve stale: got %d %q after broken change, expected error", w.Code, w.Body.String())
+			}
+		}
+
+		if err := os.WriteFile(file, []byte("fixed"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		later = later.Add(time.Hour)
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+
+		w = httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Body.String() != "fixed" {
+			t.Errorf("serve stale %v: got %q after fix, expected %q", stale, w.Body.String(), "fixed")
+		}
+	}
+}
+
+func TestIncludePattern(t *testing.T) {
+	incroot := t.TempDir()
+	if err := os.Mkdir(filepath.Join(incroot, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"head.gohtml":     `{{define "header"}}<h1>Header</h1>{{end}}`,
+		"sub/foot.gohtml": `{{define "footer"}}<p>Footer</p>{{end}}`,
+		"notes.md":        `Remember to close the {{ action`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(incroot, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pattern string
+		err     error
+		code    int
+	}{
+		{"", nil, http.StatusNotFound},
+		{"*.gohtml", nil, http.StatusOK},
+		{"[", ErrIncludesPattern, 0},
+	}
+
+	for _, elem := range tests {
+		srv, err := NewServerOpts(TestDocumentRoot,
+			WithBroker(TestBroker{}),
+			WithIncludes(incroot),
+			WithIncludePattern(elem.pattern),
+		)
+		if err != elem.err {
+			t.Errorf("include pattern %q: got error %v, expected %v", elem.pattern, err, elem.err)
+		}
+		if err != nil {
+			continue
+		}
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/temp.gohtml", nil))
+		if w.Code != elem.code {
+			t.Errorf("include pattern %q: got status %d, expected %d", elem.pattern, w.Code, elem.code)
+		}
+	}
+}
+
+func TestIncludeClash(t *testing.T) {
+	root, incroot := t.TempDir(), t.TempDir()
+	for _, elem := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(incroot, elem), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		part := `<p>Part ` + elem + `</p>`
+		if err := os.WriteFile(filepath.Join(incroot, elem, "part.gohtml"), []byte(part), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page := `{{template "a/part.gohtml"}}{{template "b/part.gohtml"}}`
+	if err := os.WriteFile(filepath.Join(root, "index.gohtml"), []byte(page), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewServerOpts(root, WithIncludes(incroot))
+	if !errors.Is(err, ErrIncludesClash) {
+		t.Errorf("include clash: got error %v, expected %v", err, ErrIncludesClash)
+	} else if !strings.Contains(err.Error(), "a/part.gohtml") || !strings.Contains(err.Error(), "b/part.gohtml") {
+		t.Errorf("include clash: error %q does not name both files", err)
+	}
+
+	srv, err := NewServerOpts(root, WithBroker(TestBroker{}), WithIncludes(incroot), WithNamespacedIncludes())
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); body != "<p>Part a</p><p>Part b</p>" {
+		t.Errorf("namespaced includes: got %q", body)
+	}
+}
+
+func TestTextMode(t *testing.T) {
+	root, incroot := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		filepath.Join(root, "report.csv"):     "{{template \"header\"}}\n{{range .rows}}{{.}}\n{{end}}",
+		filepath.Join(incroot, "header.tmpl"): `{{define "header"}}name,note{{end}}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broker := NewBroker()
+	broker.HandleData("/", map[string]interface{}{
+		"rows": []string{`ethan,"a <b> & c"`},
+	})
+
+	srv, err := NewServerOpts(root, WithBroker(broker), WithIncludes(incroot), WithTextMode())
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.ContentTypes = map[string]string{".csv": "text/csv; charset=utf-8"}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/report.csv", nil))
+
+	if body := w.Body.String(); body != "name,note\nethan,\"a <b> & c\"\n" {
+		t.Errorf("text mode: got body %q, expected unescaped output", body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("text mode: got content type %q", ct)
+	}
+}
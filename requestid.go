@@ -0,0 +1,70 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader is the header from which a request's ID is taken and in
+// which it is echoed when a server's RequestID is set.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestID is the longest inbound request ID accepted.
+const maxRequestID = 128
+
+// requestIDContextKey is the context key under which a request's ID is
+// stored.
+type requestIDContextKey struct{}
+
+// RequestIDFromContext returns the request ID stored in ctx by a server with
+// RequestID set, if any.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDContextKey{}).(string)
+	return id, ok
+}
+
+// validRequestID reports whether an inbound request ID may be used, being
+// non-empty, not too long, and made only of printable ASCII without spaces,
+// so that it is safe to echo and to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRequestID returns a new random request ID.
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// withRequestID returns r with its ID stored in its context, echoing the ID
+// in the response to w. If an ID cannot be generated, r is returned as it
+// is.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		var err error
+		if id, err = newRequestID(); err != nil {
+			return r
+		}
+	}
+
+	w.Header().Set(RequestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id))
+}
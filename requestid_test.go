@@ -0,0 +1,72 @@
+package gtemplate
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+// RequestIDBroker supplies the request ID from the context of each data
+// request.
+type RequestIDBroker struct{}
+
+func (broker RequestIDBroker) Data(path string) map[string]interface{} {
+	return nil
+}
+
+func (broker RequestIDBroker) DataCtx(ctx context.Context, path string) map[string]interface{} {
+	id, _ := RequestIDFromContext(ctx)
+	return map[string]interface{}{
+		"broker_id": id,
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/page.gohtml": {Data: []byte("{{.request_id}} {{.broker_id}}")},
+	}
+
+	srv, err := NewServerFS(fsys, "site", RequestIDBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.RequestID = true
+
+	tests := []struct {
+		inbound string
+		honored bool
+	}{
+		{"", false},
+		{"abc-123", true},
+		{"has space", false},
+		{"bad\x7f", false},
+	}
+
+	for _, elem := range tests {
+		r := httptest.NewRequest("GET", "/page.gohtml", nil)
+		if elem.inbound != "" {
+			r.Header.Set(RequestIDHeader, elem.inbound)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+
+		id := w.Header().Get(RequestIDHeader)
+		if elem.honored && id != elem.inbound {
+			t.Errorf("request id %q: got %q, expected it honored", elem.inbound, id)
+		}
+		if !elem.honored && (len(id) != 32 || id == elem.inbound) {
+			t.Errorf("request id %q: got %q, expected a generated id", elem.inbound, id)
+		}
+		if expect := id + " " + id; w.Body.String() != expect {
+			t.Errorf("request id %q: got body %q, expected %q", elem.inbound, w.Body.String(), expect)
+		}
+	}
+
+	srv.RequestID = false
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/page.gohtml", nil))
+	if id := w.Header().Get(RequestIDHeader); id != "" {
+		t.Errorf("request id disabled: got header %q, expected none", id)
+	}
+}
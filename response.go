@@ -0,0 +1,404 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryKey is the data key under which query parameters are made available
+// to templates when a server's QueryData is set.
+const QueryKey = "query"
+
+// CookiesKey is the data key under which request cookies are made available
+// to templates when a server's CookieData is set.
+const CookiesKey = "cookies"
+
+// ContentKey is the data key under which the HTML converted from a content
+// file is given to its layout. See TemplateServer.ContentLayouts.
+const ContentKey = "content"
+
+// NonceKey is the data key under which the nonce for a server's NoncePolicy
+// is made available to templates.
+const NonceKey = "csp_nonce"
+
+// ErrorKey is the data key under which a failing BrokerFunc, JSONBroker or
+// FileDataBroker reports its error, as the only key of the data. It is
+// reserved if a server's ErrorTemplate is set.
+const ErrorKey = "error"
+
+// RequestIDKey is the data key under which the ID of the request is made
+// available to templates when a server's RequestID is set.
+const RequestIDKey = "request_id"
+
+// NoncePlaceholder is replaced by the nonce for each request in a server's
+// NoncePolicy.
+const NoncePlaceholder = "{nonce}"
+
+// allowedMethods lists the methods supported for template routes.
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// DefaultSecurityHeaders returns a new map of conservative security headers,
+// for use as a server's SecurityHeaders. They disable content sniffing,
+// prevent the site being framed by others, limit the referrer sent to other
+// origins, and allow content to be loaded only from the site's own origin.
+// The map may be modified to suit, such as to relax the policy for a CDN.
+func DefaultSecurityHeaders() map[string]string {
+	return map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "SAMEORIGIN",
+		"Referrer-Policy":         "strict-origin-when-cross-origin",
+		"Content-Security-Policy": "default-src 'self'",
+	}
+}
+
+// Reserved data keys. A DataBroker may set these in the data it returns to
+// control the response, rather than for use by the template. They are removed
+// from the data before the template is executed.
+const (
+	// StatusKey sets the status code of the response. A status of 404 is
+	// handled as if the template did not exist, rendering the
+	// NotFoundTemplate if set. Any other status is sent with the rendered
+	// template.
+	StatusKey = "_status"
+
+	// RedirectKey redirects the client to the URL it is set to instead of
+	// rendering the template. The status set by StatusKey is used if it is
+	// a redirection (3xx), else 302 Found.
+	RedirectKey = "_redirect"
+
+	// HeadersKey sets response headers, given as a map[string]string,
+	// http.Header or a map[string]interface{} of strings as decoded from
+	// JSON. Headers are applied after those set by the server, such as the
+	// Content-Type derived from the template path, and so take precedence
+	// over them. They are also applied to redirects and to not found
+	// responses, although the latter always have an HTML Content-Type.
+	HeadersKey = "_headers"
+
+	// ModTimeKey gives the time at which the data was last modified,
+	// as a time.Time, a string in RFC 3339 or HTTP date format, or an
+	// integer or float64 of seconds since the Unix epoch as decoded from
+	// JSON. Under a server's LastModified, it is sent as the
+	// Last-Modified header if later than the template's file.
+	ModTimeKey = "_modtime"
+)
+
+// maxPooledBuffer is the capacity above which render buffers are discarded
+// rather than pooled, so that one very large page does not pin its memory.
+const maxPooledBuffer = 1 << 20
+
+// bufferPool holds buffers into which responses are rendered.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool. Its contents must no longer be in use.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// directives are the response controls set by reserved data keys.
+type directives struct {
+	status   int
+	redirect string
+	headers  http.Header
+	modTime  time.Time
+}
+
+// reserved reports whether k is a reserved data key.
+func reserved(k string) bool {
+	return k == StatusKey || k == RedirectKey || k == HeadersKey || k == ModTimeKey
+}
+
+// header returns the headers represented by v, or nil if v is not a
+// supported type.
+func header(v interface{}) http.Header {
+	h := make(http.Header)
+	switch v := v.(type) {
+	case http.Header:
+		for k, vals := range v {
+			for _, elem := range vals {
+				h.Add(k, elem)
+			}
+		}
+	case map[string]string:
+		for k, val := range v {
+			h.Set(k, val)
+		}
+	case map[string]interface{}:
+		for k, val := range v {
+			if s, ok := val.(string); ok {
+				h.Set(k, s)
+			}
+		}
+	default:
+		return nil
+	}
+
+	return h
+}
+
+// apply sets the headers of the directives on w, replacing any existing
+// values.
+func (d directives) apply(w http.ResponseWriter) {
+	for k, vals := range d.headers {
+		w.Header()[k] = vals
+	}
+}
+
+// statusCode returns the status code represented by v, which may be any
+// integer or a whole float64 as decoded from JSON.
+func statusCode(v interface{}) (int, bool) {
+	var code int
+	switch v := v.(type) {
+	case int:
+		code = v
+	case int64:
+		code = int(v)
+	case float64:
+		code = int(v)
+		if float64(code) != v {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	return code, code >= 100 && code <= 999
+}
+
+// modTime returns the time represented by v, which may be a time.Time, a
+// string in RFC 3339 or HTTP date format, or an integer or float64 of
+// seconds since the Unix epoch.
+func modTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, !v.IsZero()
+	case string:
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, true
+		}
+		t, err := http.ParseTime(v)
+		return t, err == nil
+	case int:
+		return time.Unix(int64(v), 0), true
+	case int64:
+		return time.Unix(v, 0), true
+	case float64:
+		return time.Unix(int64(v), 0), true
+	}
+
+	return time.Time{}, false
+}
+
+// extractDirectives returns the directives set by the reserved keys of dat,
+// along with the remaining data to pass to the template. dat itself is never
+// modified, as brokers may return the same map to many requests.
+func extractDirectives(dat map[string]interface{}) (map[string]interface{}, directives) {
+	d := directives{status: http.StatusOK}
+
+	n := 0
+	for k := range dat {
+		if reserved(k) {
+			n++
+		}
+	}
+	if n == 0 {
+		return dat, d
+	}
+
+	if code, ok := statusCode(dat[StatusKey]); ok {
+		d.status = code
+	}
+	d.redirect, _ = dat[RedirectKey].(string)
+	d.headers = header(dat[HeadersKey])
+	d.modTime, _ = modTime(dat[ModTimeKey])
+
+	clean := make(map[string]interface{}, len(dat)-n)
+	for k, v := range dat {
+		if !reserved(k) {
+			clean[k] = v
+		}
+	}
+
+	return clean, d
+}
+
+// acceptsGzip reports whether the client making r accepts gzip encoded
+// responses. A q-value given for gzip itself takes precedence over that of
+// "*", whatever their order.
+func acceptsGzip(r *http.Request) bool {
+	gzip, star := -1.0, -1.0 // q-values, or -1 if not given
+	for _, elem := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(elem, ";")
+		coding = strings.TrimSpace(coding)
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		// Explicitly unacceptable codings have q=0, as in "gzip;q=0"
+		q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(params), "q="), 64)
+		if err != nil {
+			q = 1
+		}
+		if coding == "gzip" {
+			gzip = q
+		} else {
+			star = q
+		}
+	}
+
+	if gzip >= 0 {
+		return gzip > 0
+	}
+	return star > 0
+}
+
+// etag returns a strong entity tag for body. Gzipped representations are
+// given a distinct tag.
+func etag(body []byte, gzipped bool) string {
+	h := fnv.New64a()
+	h.Write(body)
+
+	tag := strconv.FormatUint(h.Sum64(), 16)
+	if gzipped {
+		tag += "-gzip"
+	}
+	return `"` + tag + `"`
+}
+
+// etagMatch reports whether tag is matched by the If-None-Match header value
+// header, using the weak comparison function.
+func etagMatch(header, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, elem := range strings.Split(header, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "*" || strings.TrimPrefix(elem, "W/") == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified reports whether the client making r already holds the
+// response last modified at lastModified, according to If-Modified-Since.
+// As with http.ServeContent, If-Modified-Since is ignored if the request
+// carries If-None-Match.
+func notModified(r *http.Request, lastModified time.Time) bool {
+	if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// Header resolution is one second
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// compress reports whether a response of size bytes to r should be gzip
+// compressed. A negative size is unknown.
+func (srv *TemplateServer) compress(r *http.Request, size int) bool {
+	if !srv.Compression || (size >= 0 && size < srv.CompressionMinSize) {
+		return false
+	}
+
+	return acceptsGzip(r)
+}
+
+// flushWriter streams output to the client, flushing it after a write if at
+// least interval has passed since the last flush.
+type flushWriter struct {
+	w        io.Writer
+	f        http.Flusher
+	interval time.Duration
+	last     time.Time
+}
+
+// newFlushWriter returns a flushWriter writing to w and flushing f. If w is a
+// gzip.Writer, it is flushed first, so that the compressed output is sent.
+func newFlushWriter(w io.Writer, f http.Flusher, interval time.Duration) *flushWriter {
+	return &flushWriter{w: w, f: f, interval: interval, last: time.Now()}
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if err == nil && time.Since(fw.last) >= fw.interval {
+		if gz, ok := fw.w.(*gzip.Writer); ok {
+			err = gz.Flush()
+		}
+		fw.f.Flush()
+		fw.last = time.Now()
+	}
+
+	return n, err
+}
+
+// writeBody sends the complete rendered body for r with the given status,
+// compressing it if appropriate.
+func (srv *TemplateServer) writeBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+	if srv.Compression {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	gzipped := srv.compress(r, len(body))
+	if srv.ETag {
+		tag := etag(body, gzipped)
+		w.Header().Set("ETag", tag)
+
+		if status == http.StatusOK && (r.Method == "GET" || r.Method == "HEAD") && etagMatch(r.Header.Get("If-None-Match"), tag) {
+			w.Header().Del("Content-Type")
+			w.Header().Del("Content-Length")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// Type must be detected before the content is compressed or the
+	// status is written
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(body))
+	}
+
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(status)
+		if r.Method == "HEAD" {
+			return
+		}
+
+		gz := gzip.NewWriter(w)
+		gz.Write(body)
+		gz.Close()
+		return
+	}
+
+	// HEAD responses carry the length of the body a GET would receive
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+// layeredFS is a filesystem made of layers in order of precedence. Each file
+// is opened from the first layer in which it exists, and directories list
+// the files of every layer.
+type layeredFS []fs.FS
+
+// layer returns the index of the first layer in which name exists, or -1.
+func (l layeredFS) layer(name string) int {
+	for i, elem := range l {
+		if _, err := fs.Stat(elem, name); err == nil {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (l layeredFS) Open(name string) (fs.File, error) {
+	for _, elem := range l {
+		f, err := elem.Open(name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (l layeredFS) Stat(name string) (fs.FileInfo, error) {
+	for _, elem := range l {
+		info, err := fs.Stat(elem, name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return info, err
+		}
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir lists the directory name in every layer in which it exists, sorted
+// by file name. Entries of earlier layers shadow those of later ones.
+func (l layeredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var (
+		found   bool
+		entries []fs.DirEntry
+		seen    = make(map[string]bool)
+	)
+	for _, elem := range l {
+		list, err := fs.ReadDir(elem, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		found = true
+		for _, e := range list {
+			if !seen[e.Name()] {
+				seen[e.Name()] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// layer returns the index of the document root from which the file at name
+// is loaded, or 0 if the server has only one root.
+func (srv *TemplateServer) layer(name string) int {
+	if l, ok := srv.fsys.(layeredFS); ok {
+		return l.layer(name)
+	}
+
+	return 0
+}
+
+// NewServerRoots instantiates a new TemplateServer serving templates from
+// several document roots, in order of precedence, such as a site's own
+// templates followed by those of the theme it overrides. Each template is
+// loaded from the first root in which its file exists, and directories list
+// the templates of every root. A cached template is reloaded in DevMode if
+// the root from which it would be loaded changes, such as when an override
+// is added. Error is returned if no roots are given or any root is not a
+// valid directory.
+func NewServerRoots(roots []string, data DataBroker) (*TemplateServer, error) {
+	if len(roots) == 0 {
+		return nil, ErrRootInvalid
+	}
+	if len(roots) == 1 {
+		return NewServer(roots[0], data)
+	}
+
+	layers := make(layeredFS, len(roots))
+	for i, elem := range roots {
+		if !verifyDirectory(elem) {
+			return nil, ErrRootInvalid
+		}
+		layers[i] = os.DirFS(elem)
+	}
+
+	srv := newServer(layers, data)
+	srv.roots = append([]string(nil), roots...)
+	return srv, nil
+}
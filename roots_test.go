@@ -0,0 +1,84 @@
+package gtemplate
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerRoots(t *testing.T) {
+	base, site := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		filepath.Join(base, "index.gohtml"):    "base index",
+		filepath.Join(base, "page.gohtml"):     "base page",
+		filepath.Join(base, "sub", "a.gohtml"): "base a",
+		filepath.Join(site, "page.gohtml"):     "site page",
+		filepath.Join(site, "sub", "b.gohtml"): "site b",
+	}
+	for p, content := range files {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewServerRoots(nil, TestBroker{}); err != ErrRootInvalid {
+		t.Errorf("roots: got error %v with no roots, expected %v", err, ErrRootInvalid)
+	}
+	if _, err := NewServerRoots([]string{site, filepath.Join(base, "missing")}, TestBroker{}); err != ErrRootInvalid {
+		t.Errorf("roots: got error %v with missing root, expected %v", err, ErrRootInvalid)
+	}
+
+	srv, err := NewServerRoots([]string{site, base}, TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.DevMode = true
+
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/", "base index"},
+		{"/page.gohtml", "site page"},
+		{"/sub/a.gohtml", "base a"},
+		{"/sub/b.gohtml", "site b"},
+	}
+	for _, elem := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", elem.path, nil))
+
+		if w.Body.String() != elem.body {
+			t.Errorf("roots %q: got body %q, expected %q", elem.path, w.Body.String(), elem.body)
+		}
+	}
+
+	expected := []string{"/index.gohtml", "/page.gohtml", "/sub/a.gohtml", "/sub/b.gohtml"}
+	if got := srv.Templates(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("roots templates: got %q, expected %q", got, expected)
+	}
+
+	// An override added with the same modification time is still found
+	p := filepath.Join(site, "sub", "a.gohtml")
+	if err := os.WriteFile(p, []byte("site a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(base, "sub", "a.gohtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, time.Now(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/sub/a.gohtml", nil))
+	if w.Body.String() != "site a" {
+		t.Errorf("roots override: got body %q, expected %q", w.Body.String(), "site a")
+	}
+}
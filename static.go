@@ -0,0 +1,134 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// isStatic reports whether the file at p is served as it is. See
+// TemplateServer.StaticExtensions.
+func (srv *TemplateServer) isStatic(p string) bool {
+	ext := strings.ToLower(path.Ext(p))
+	for _, elem := range srv.StaticExtensions {
+		if ext != "" && strings.ToLower(elem) == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+// staticContentType returns the Content-Type of the static file at p, or the
+// empty string if unknown. Unlike for templates, neither TextMode nor TextPaths
+// nor a negotiated variant affects the type of a static file.
+func (srv *TemplateServer) staticContentType(p string) string {
+	ext := strings.ToLower(path.Ext(p))
+	if ct, ok := srv.ContentTypes[ext]; ok {
+		return ct
+	}
+	if ct, ok := DefaultContentTypes[ext]; ok {
+		return ct
+	}
+
+	return mime.TypeByExtension(ext)
+}
+
+// openStatic opens the static file at p within the document root, returning
+// it with its information. Directories are reported as not existing.
+func (srv *TemplateServer) openStatic(p string) (fs.File, fs.FileInfo, error) {
+	name := strings.TrimPrefix(p, "/")
+	if !srv.inRoot(name) {
+		return nil, nil, fs.ErrNotExist
+	}
+
+	f, err := srv.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, nil, fs.ErrNotExist
+	}
+
+	return f, info, nil
+}
+
+// serveStatic serves the static file at p, or its precompressed sibling if
+// PrecompressedStatic is set and it may be used.
+func (srv *TemplateServer) serveStatic(w http.ResponseWriter, r *http.Request, p string) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "OPTIONS":
+		w.Header().Set("Allow", allowedMethods)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, info, err := srv.openStatic(p)
+	if err != nil {
+		srv.notFound(w, r, p, nil)
+		return
+	}
+	defer f.Close()
+
+	if ct := srv.staticContentType(p); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if cc := srv.cacheControlFor(p); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+	if srv.PrecompressedStatic {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if acceptsGzip(r) {
+			gz, gzinfo, err := srv.openStatic(p + ".gz")
+			if err == nil {
+				defer gz.Close()
+
+				if !gzinfo.ModTime().Before(info.ModTime()) {
+					if w.Header().Get("Content-Type") == "" {
+						w.Header().Set("Content-Type", "application/octet-stream")
+					}
+					w.Header().Set("Content-Encoding", "gzip")
+					f = gz
+				}
+			}
+		}
+	}
+
+	content, err := seeker(f)
+	if err != nil {
+		srv.serveError(w, r, err)
+		return
+	}
+
+	http.ServeContent(w, r, path.Base(p), info.ModTime(), content)
+}
+
+// seeker returns f as an io.ReadSeeker, reading it into memory if it cannot
+// seek itself.
+func seeker(f fs.File) (io.ReadSeeker, error) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(buf), nil
+}
@@ -0,0 +1,107 @@
+package gtemplate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestStatic(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("body { color: red; }"))
+	zw.Close()
+
+	now := time.Now()
+	fsys := fstest.MapFS{
+		"site/style.css":    {Data: []byte("body { color: red; }"), ModTime: now},
+		"site/style.css.gz": {Data: gz.Bytes(), ModTime: now},
+		"site/old.css":      {Data: []byte("old"), ModTime: now},
+		"site/old.css.gz":   {Data: gz.Bytes(), ModTime: now.Add(-time.Hour)},
+		"site/tmpl.css":     {Data: []byte("{{.title}}"), ModTime: now},
+	}
+
+	srv, err := NewServerFS(fsys, "site", TestBroker{})
+	if err != nil {
+		t.Fatalf("Server init failed: %s", err.Error())
+	}
+	srv.StaticExtensions = []string{".CSS"}
+	srv.PrecompressedStatic = true
+
+	tests := []struct {
+		path     string
+		gzip     bool
+		code     int
+		encoding string
+		body     string
+	}{
+		{"/style.css", false, http.StatusOK, "", "body { color: red; }"},
+		{"/style.css", true, http.StatusOK, "gzip", "body { color: red; }"},
+		{"/old.css", true, http.StatusOK, "", "old"},
+		{"/tmpl.css", false, http.StatusOK, "", "{{.title}}"},
+		{"/missing.css", true, http.StatusNotFound, "", ""},
+	}
+
+	for _, elem := range tests {
+		r := httptest.NewRequest("GET", elem.path, nil)
+		if elem.gzip {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+
+		if w.Code != elem.code {
+			t.Errorf("static %q: got status %d, expected %d", elem.path, w.Code, elem.code)
+			continue
+		}
+		if elem.code != http.StatusOK {
+			continue
+		}
+		if enc := w.Header().Get("Content-Encoding"); enc != elem.encoding {
+			t.Errorf("static %q: got encoding %q, expected %q", elem.path, enc, elem.encoding)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/css; charset=utf-8" {
+			t.Errorf("static %q: got content type %q, expected css", elem.path, ct)
+		}
+
+		body := w.Body.Bytes()
+		if elem.encoding == "gzip" {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = io.ReadAll(zr)
+		}
+		if string(body) != elem.body {
+			t.Errorf("static %q: got body %q, expected %q", elem.path, body, elem.body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "/style.css", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("static post: got status %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// Static files keep their own types under TextMode
+	srv.TextMode = true
+	srv.StaticExtensions = []string{".css", ".png"}
+	fsys["site/logo.png"] = &fstest.MapFile{Data: []byte("\x89PNG\r\n\x1a\n"), ModTime: now}
+
+	types := map[string]string{
+		"/style.css": "text/css; charset=utf-8",
+		"/logo.png":  "image/png",
+	}
+	for p, expected := range types {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if ct := w.Header().Get("Content-Type"); ct != expected {
+			t.Errorf("static text mode %q: got content type %q, expected %q", p, ct, expected)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 Ethan Marshall.
+// Licensed under the ISC licence - see COPYING.
+package gtemplate
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A TemplateError is an error parsing or executing a template, locating the
+// fault within its files. It wraps the error returned by the template
+// package, so that it may still be inspected with errors.Is and errors.As.
+type TemplateError struct {
+	Path string // path of the requested template, such as "/page.gohtml"
+	Name string // name of the template at fault, being a page, layout or include
+	Line int    // line number within Name
+	Err  error  // underlying error
+}
+
+// templateErrorRE matches the location prefixed to errors by text/template
+// and html/template, capturing the template name, line and message.
+var templateErrorRE = regexp.MustCompile(`^(?:html/)?template: ?([^:]+):(\d+)(?::\d+)?: (?s:(.*))$`)
+
+// templateError wraps err, returned parsing or executing the template at p,
+// as a TemplateError if it names the location of the fault. Other errors are
+// returned unchanged.
+func templateError(p string, err error) error {
+	m := templateErrorRE.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+
+	line, _ := strconv.Atoi(m[2])
+	return &TemplateError{Path: p, Name: m[1], Line: line, Err: err}
+}
+
+// Error returns the location and message of the error, omitting the name
+// of the template at fault if it is the requested template itself, as in
+// "gtemplate: /page.gohtml:3: unexpected EOF".
+func (e *TemplateError) Error() string {
+	msg := e.Err.Error()
+	if m := templateErrorRE.FindStringSubmatch(msg); m != nil {
+		msg = m[3]
+	}
+
+	if e.Name == path.Base(e.Path) || e.Name == strings.TrimPrefix(e.Path, "/") {
+		return fmt.Sprintf("gtemplate: %s:%d: %s", e.Path, e.Line, msg)
+	}
+	return fmt.Sprintf("gtemplate: %s: %s:%d: %s", e.Path, e.Name, e.Line, msg)
+}
+
+// Unwrap returns the underlying error.
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}